@@ -1,6 +1,9 @@
 package app
 
 import (
+	"errors"
+	"time"
+
 	"github.com/ant0ine/go-json-rest/rest"
 	"github.com/julienbayle/go-json-rest-middleware-jwt"
 	"github.com/julienbayle/jeparticipe/email"
@@ -15,45 +18,122 @@ const (
 )
 
 type App struct {
-	RepositoryService  *services.RepositoryService
+	Store              services.Store
 	ActivityService    *services.ActivityService
 	EventService       *services.EventService
+	SnapshotService    *services.SnapshotService
+	RetentionService   *services.RetentionService
+	ExpiryService      *services.ExpiryService
+	ScheduleService    *services.ScheduleService
 	Secret             string
-	SuperAdminPassword string
+	SuperAdminPassword string // Only known when the password has just been generated
+	SuperAdminHash     string
 }
 
-// Inits a new "Jeparticipe" application
-func NewApp(dbFilePath string) *App {
-	repositoryService := services.NewRepositoryService(dbFilePath)
-	repositoryService.CreateCollectionIfNotExists(services.EventsBucketName)
-	repositoryService.CreateCollectionIfNotExists(services.PropertiesBucketName)
+// Inits a new "Jeparticipe" application using the given store
+func NewApp(store services.Store) *App {
+	store.CreateCollectionIfNotExists(services.EventsBucketName)
+	store.CreateCollectionIfNotExists(services.PropertiesBucketName)
+	store.CreateCollectionIfNotExists(services.TombstonesBucketName)
 
 	// App secret is used to generate tokens (event confirmation code, JWT toket, ...)
-	secret := services.GetProperty(repositoryService, "secret", services.NewPassword(64))
+	secret := services.GetProperty(store, "secret", services.NewPassword(64))
+
+	// Superadmin password allows to be admin in all events, only its hash is saved
+	superAdminPassword, superAdminHash := services.InitSuperAdminPassword(store)
+
+	emailRelay := &email.EmailRelay{
+		Send: email.SendWithMailjet,
+	}
+
+	activityService := &services.ActivityService{
+		Store:      store,
+		EmailRelay: emailRelay,
+		Secret:     secret,
+	}
+
+	eventService := &services.EventService{
+		Store:           store,
+		EmailRelay:      emailRelay,
+		Secret:          secret,
+		CoolingOff:      services.DefaultCoolingOff,
+		PendingExpiry:   services.DefaultPendingExpiry,
+		LoginLinkExpiry: services.DefaultLoginLinkExpiry,
+		TokenTimeout:    services.DefaultTokenTimeout,
+	}
 
-	// Superadmin password allows to be admin in all events
-	superAdminPassword := services.GetProperty(repositoryService, "superadminpass", services.NewPassword(12))
+	// Event passwords were saved in clear text by previous versions
+	if _, err := eventService.HashPasswords(); err != nil {
+		panic(err)
+	}
 
 	return &App{
 		Secret:             secret,
 		SuperAdminPassword: superAdminPassword,
-		RepositoryService:  repositoryService,
-		ActivityService: &services.ActivityService{
-			RepositoryService: repositoryService,
+		SuperAdminHash:     superAdminHash,
+		Store:              store,
+		ActivityService:    activityService,
+		RetentionService: &services.RetentionService{
+			ActivityService: activityService,
+			Retention:       services.DefaultRetention,
 		},
-		EventService: &services.EventService{
-			RepositoryService: repositoryService,
-			EmailRelay: &email.EmailRelay{
-				Send: email.SendWithMailjet,
-			},
-			Secret: secret,
+		EventService: eventService,
+		ExpiryService: &services.ExpiryService{
+			EventService: eventService,
 		},
+		ScheduleService: &services.ScheduleService{
+			ActivityService: activityService,
+		},
+	}
+}
+
+// Starts periodic snapshots of the database (BoltDB only)
+// Latest snapshot of each of the last keepDaily days and keepWeekly weeks are kept
+func (app *App) StartSnapshots(directory string, interval time.Duration, keepDaily int, keepWeekly int) error {
+	repositoryService, ok := app.Store.(*services.RepositoryService)
+	if !ok {
+		return errors.New("Snapshots are only available with a BoltDB database")
+	}
+
+	app.SnapshotService = &services.SnapshotService{
+		RepositoryService: repositoryService,
+		Directory:         directory,
+		Interval:          interval,
+		KeepDaily:         keepDaily,
+		KeepWeekly:        keepWeekly,
 	}
+	return app.SnapshotService.Start()
+}
+
+// Starts periodic purges of the participants deleted for more than the retention delay
+func (app *App) StartRetention(retention time.Duration, interval time.Duration) error {
+	app.RetentionService.Retention = retention
+	app.RetentionService.Interval = interval
+	return app.RetentionService.Start()
+}
+
+// Starts periodic removals of the pending events which are not confirmed after the expiry delay
+func (app *App) StartExpiry(pendingExpiry time.Duration, interval time.Duration) error {
+	app.EventService.PendingExpiry = pendingExpiry
+	app.ExpiryService.Interval = interval
+	return app.ExpiryService.Start()
+}
+
+// Starts periodic checks of the scheduled activity openings and closings
+func (app *App) StartSchedule(interval time.Duration) error {
+	app.ScheduleService.Interval = interval
+	return app.ScheduleService.Start()
 }
 
 // Closes socket or open files on shutdown
 func (app *App) ShutDown() {
-	app.RepositoryService.ShutDown()
+	if app.SnapshotService != nil {
+		app.SnapshotService.Stop()
+	}
+	app.RetentionService.Stop()
+	app.ExpiryService.Stop()
+	app.ScheduleService.Stop()
+	app.Store.ShutDown()
 }
 
 // Build an "jeparticipe" API endpoint
@@ -75,17 +155,25 @@ func (app *App) BuildApi(mode string, baseUrl string) *rest.Api {
 			return true
 		},
 		AllowedMethods:                []string{"GET", "POST", "PUT", "DELETE"},
-		AllowedHeaders:                []string{"Accept", "Content-Type", "Origin", "Authorization"},
+		AllowedHeaders:                []string{"Accept", "Content-Type", "Origin", "Authorization", "If-Match", "X-Participant-Token"},
+		AccessControlExposeHeaders:    []string{"ETag"},
 		AccessControlAllowCredentials: true,
 		AccessControlMaxAge:           3600,
 	})
 
 	// Init JWT middleware
 	jwt_middleware := &jwt.JWTMiddleware{
-		Key:   []byte(app.Secret),
-		Realm: "Jeparticipe auth",
+		Key:     []byte(app.Secret),
+		Realm:   "Jeparticipe auth",
+		Timeout: app.EventService.TokenTimeout,
 		Authenticator: func(userId string, password string) bool {
-			return services.Authenticate(app.EventService, app.SuperAdminPassword, userId, password)
+			return services.Authenticate(app.EventService, app.SuperAdminHash, userId, password)
+		},
+		Authorizator: func(userId string, request *rest.Request) bool {
+			return services.Authorize(app.EventService, userId, request)
+		},
+		PayloadFunc: func(userId string) map[string]interface{} {
+			return services.TokenPayload(app.EventService, userId)
 		},
 		LogFunc: func(logMessage string) {
 			fmt.Printf("JWT Middleware : %s", logMessage)
@@ -103,26 +191,56 @@ func (app *App) BuildApi(mode string, baseUrl string) *rest.Api {
 	// Adds routes
 	uLogin := baseUrl + "/login"
 	uBackup := baseUrl + "/backup"
+	uPurge := baseUrl + "/purge"
 	uEvent := baseUrl + "/event"
 	uBucket := uEvent + "/:event/activity/:acode"
 
-	router, err := rest.MakeRouter(
+	routes := []*rest.Route{
 		rest.Post(uLogin, jwt_middleware.LoginHandler),
 
-		rest.Get(uBackup, app.RepositoryService.Backup),
+		rest.Get(uPurge, app.RetentionService.GetPurgeReport),
+		rest.Post(uPurge, app.RetentionService.PurgeParticipants),
 
+		rest.Get(uEvent, app.EventService.GetEvents),
 		rest.Post(uEvent, app.EventService.CreatePendingEvent),
 		rest.Get(uEvent+"/:event/lostaccount", app.EventService.SendEventInformationByMail),
 		rest.Get(uEvent+"/:event/confirm/:confirm_code", app.EventService.ConfirmEvent),
+		rest.Delete(uEvent+"/:event", app.EventService.DeleteEvent),
 		rest.Get(uEvent+"/:event/status", app.EventService.GetEventStatus),
 		rest.Get(uEvent+"/:event/config", app.EventService.GetEventConfig),
 		rest.Put(uEvent+"/:event/config", app.EventService.SetEventConfig),
-
+		rest.Put(uEvent+"/:event/password", app.EventService.ChangeEventPassword),
+		rest.Post(uEvent+"/:event/password/reset", app.EventService.ResetEventPassword),
+		rest.Post(uEvent+"/:event/login", app.EventService.LoginWithLink),
+		rest.Get(uEvent+"/:event/organizers", app.EventService.GetOrganizers),
+		rest.Post(uEvent+"/:event/organizers", app.EventService.InviteOrganizer),
+		rest.Put(uEvent+"/:event/organizers/#email", app.EventService.UpdateOrganizer),
+		rest.Delete(uEvent+"/:event/organizers/#email", app.EventService.RevokeOrganizer),
+
+		rest.Get(uEvent+"/:event/activities", app.ActivityService.GetActivities),
+		rest.Put(uEvent+"/:event/activities/state/:state", app.ActivityService.UpdateActivitiesState),
 		rest.Get(uBucket, app.ActivityService.GetActivity),
+		rest.Put(uBucket, app.ActivityService.UpdateActivityDetails),
 		rest.Put(uBucket+"/state/:state", app.ActivityService.UpdateActivityState),
 		rest.Put(uBucket+"/participant", app.ActivityService.AddAParticipantToAnActivity),
+		rest.Put(uBucket+"/participant/:pcode", app.ActivityService.UpdateAParticipantOfAnActivity),
+		rest.Put(uBucket+"/participant/:pcode/move/:target", app.ActivityService.MoveAParticipant),
 		rest.Get(uBucket+"/participant/:pcode/delete", app.ActivityService.RemoveAParticipantFromAnActivity),
-	)
+	}
+
+	// Raw database backup and restore are only available with the BoltDB store
+	if repositoryService, ok := app.Store.(*services.RepositoryService); ok {
+		routes = append(routes,
+			rest.Get(uBackup, repositoryService.Backup),
+			rest.Post(uBackup+"/restore", repositoryService.Restore),
+		)
+	}
+
+	if app.SnapshotService != nil {
+		routes = append(routes, rest.Get(uBackup+"/snapshots", app.SnapshotService.GetSnapshots))
+	}
+
+	router, err := rest.MakeRouter(routes...)
 
 	if err != nil {
 		panic(err)
@@ -7,14 +7,18 @@ import (
 	"github.com/julienbayle/jeparticipe/services"
 
 	"net/http"
-	"os"
 	"testing"
 )
 
-// Creates a test application
+// Creates a test application backed by a memory store
 func CreateATestApp() (*app.App, http.Handler, *entities.Event) {
+	return CreateATestAppWithStore(services.NewMemoryStore())
+}
+
+// Creates a test application backed by the given store
+func CreateATestAppWithStore(store services.Store) (*app.App, http.Handler, *entities.Event) {
 	// Initialize the app
-	jeparticipe := app.NewApp("test.db")
+	jeparticipe := app.NewApp(store)
 
 	// Initialize the API endpoint
 	restapi := jeparticipe.BuildApi(app.TestMode, "")
@@ -27,15 +31,14 @@ func CreateATestApp() (*app.App, http.Handler, *entities.Event) {
 	return jeparticipe, handler, event
 }
 
-// Closes database and remove database file
+// Closes the test application store
 func DeleteTestApp(aApp *app.App) {
-	defer aApp.ShutDown()
-	defer os.Remove("test.db")
+	aApp.ShutDown()
 }
 
 // Returns a login token
 func GetAdminTokenForEvent(t *testing.T, handler *http.Handler, event *entities.Event) string {
-	loginCreds := map[string]string{"username": event.Code + "-admin", "password": event.AdminPassword}
+	loginCreds := map[string]string{"username": event.Code + "-admin", "password": event.Password}
 	rightCredReq := test.MakeSimpleRequest("POST", "/login", loginCreds)
 	recorded := test.RunRequest(t, *handler, rightCredReq)
 	recorded.CodeIs(200)
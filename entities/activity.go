@@ -1,20 +1,71 @@
 package entities
 
 import (
+	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"time"
 )
 
 const (
-	StateOpen   = "open"
-	StateClosed = "close"
+	StateOpen     = "open"
+	StateClosed   = "close"
+	StateDraft    = "draft"
+	StateArchived = "archived"
+
+	MaxTitleLength       = 200
+	MaxDescriptionLength = 5000
+	MaxLocationLength    = 200
+	MaxTags              = 20
+	MaxTagLength         = 50
+
+	// Maximum number of people a participant entry can represent
+	MaxHeadCount = 20
+
+	// Activities are created by their first participant, any code matching this expression is valid
+	ActivityCodeRegExp = "^[-A-Za-z0-9]{2,50}$"
 )
 
 type Activity struct {
-	Code         string
-	State        string
+	Code  string
+	State string
+	ActivityDetails
 	Participants []*Participant
+	Revision     int
+
+	// Participants waiting for a free place, first come first served
+	Waitlist []*Participant
+
+	// True when the activity has been closed because it reached its capacity
+	AutoClosed bool
+}
+
+// ActivityDetails describes what, when and where an activity is (all fields are optional)
+type ActivityDetails struct {
+	Title       string
+	Description string
+	StartAt     time.Time
+	EndAt       time.Time
+	Location    string
+	Order       int
+	Tags        []string
+
+	// Maximum number of participants (0 means no limit)
+	Capacity int
+
+	// Reopens an activity closed because it was full when a participant cancels
+	ReopenWhenAvailable bool
+
+	// Sign-ups beyond capacity go to the waiting list instead of being refused
+	WaitlistEnabled bool
+
+	// Scheduled opening and closing (zero means not scheduled, reset once applied)
+	OpenAt  time.Time
+	CloseAt time.Time
+
+	// Questions asked to the participants when they sign up
+	Form []*FormField
 }
 
 type Participant struct {
@@ -23,7 +74,29 @@ type Participant struct {
 	PrivateText string    `json:"admintext"`
 	CreatedAt   time.Time `json:"createdAt"`
 	CreatedBy   string    `json:"createdBy"`
+	UpdatedAt   time.Time `json:"updatedAt"`
 	DeletedAt   time.Time `json:"deletedAt"`
+	Email       string    `json:"email"`
+
+	// Number of people signed up by this entry (0 means 1)
+	Count int `json:"count"`
+
+	// Answers to the activity form, by field name
+	Answers map[string]string `json:"answers"`
+
+	// Moves of the participant between activities
+	History []*ParticipantMove `json:"history"`
+
+	// Secret token allowing the participant to edit or cancel its participation
+	// Only sent back once, when the participant signs up (never saved)
+	Token string `json:"token,omitempty"`
+}
+
+type ParticipantMove struct {
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	MovedAt time.Time `json:"movedAt"`
+	MovedBy string    `json:"movedBy"`
 }
 
 // Creates a new activity
@@ -32,25 +105,103 @@ func NewActivity(code string) *Activity {
 		Code:         code,
 		State:        StateOpen,
 		Participants: make([]*Participant, 0),
+		Waitlist:     make([]*Participant, 0),
 	}
 }
 
 // Adds a participant to an activity
 // A new participant will be auto-deleted one year later
 func (activity *Activity) AddParticipant(publicText string, privateText string, ip string) *Participant {
-	p := &Participant{
-		PublicText:  publicText,
-		PrivateText: privateText,
-		CreatedAt:   time.Now(),
-		CreatedBy:   ip,
-		DeletedAt:   time.Now().AddDate(1, 0, 0),
-	}
-	p.Code = generateParticipantCode(p)
+	p := newParticipant(publicText, privateText, ip)
 	activity.Participants = append(activity.Participants, p)
 
 	return p
 }
 
+// Checks activity details values
+func (details *ActivityDetails) Validate() error {
+	if len(details.Title) > MaxTitleLength {
+		return errors.New("Title is too long")
+	}
+	if len(details.Description) > MaxDescriptionLength {
+		return errors.New("Description is too long")
+	}
+	if len(details.Location) > MaxLocationLength {
+		return errors.New("Location is too long")
+	}
+	if !details.StartAt.IsZero() && !details.EndAt.IsZero() && details.EndAt.Before(details.StartAt) {
+		return errors.New("End time is before start time")
+	}
+	if len(details.Tags) > MaxTags {
+		return errors.New("Too many tags")
+	}
+	for _, tag := range details.Tags {
+		if tag == "" || len(tag) > MaxTagLength {
+			return errors.New("Invalid tag")
+		}
+	}
+	if err := ValidateForm(details.Form); err != nil {
+		return err
+	}
+	if details.Order < 0 {
+		return errors.New("Order must not be negative")
+	}
+	if details.Capacity < 0 {
+		return errors.New("Capacity must be positive")
+	}
+	if !details.OpenAt.IsZero() && !details.CloseAt.IsZero() && details.CloseAt.Before(details.OpenAt) {
+		return errors.New("Closing time is before opening time")
+	}
+	return nil
+}
+
+// Adds a participant at the end of the waiting list
+func (activity *Activity) AddToWaitlist(publicText string, privateText string, ip string) *Participant {
+	p := newParticipant(publicText, privateText, ip)
+	activity.Waitlist = append(activity.Waitlist, p)
+
+	return p
+}
+
+// Returns a participant from the waiting list
+func (activity *Activity) GetWaitlisted(code string) *Participant {
+	for _, p := range activity.Waitlist {
+		if p.Code == code {
+			return p
+		}
+	}
+	return nil
+}
+
+// Removes a participant from the waiting list
+func (activity *Activity) RemoveFromWaitlist(code string) *Participant {
+	for k, p := range activity.Waitlist {
+		if p.Code == code {
+			activity.Waitlist = append(activity.Waitlist[:k], activity.Waitlist[k+1:]...)
+			return p
+		}
+	}
+	return nil
+}
+
+// Moves the first participants of the waiting list to the participants while they fit in the activity
+// Returns the promoted participants
+func (activity *Activity) PromoteFromWaitlist() []*Participant {
+	promoted := make([]*Participant, 0)
+	for len(activity.Waitlist) > 0 && activity.HasRoomFor(activity.Waitlist[0].HeadCount()) {
+		p := activity.Waitlist[0]
+		activity.Waitlist = activity.Waitlist[1:]
+		activity.Participants = append(activity.Participants, p)
+		promoted = append(promoted, p)
+	}
+	return promoted
+}
+
+// Returns true if a new sign-up would go to the waiting list
+func (activity *Activity) IsWaitlistOpen() bool {
+	return activity.WaitlistEnabled && activity.IsFull() && (activity.IsOpen() || activity.AutoClosed)
+}
+
 // Returns a participant from an activity
 func (activity *Activity) GetParticipant(code string) *Participant {
 	for k, v := range activity.Participants {
@@ -61,6 +212,46 @@ func (activity *Activity) GetParticipant(code string) *Participant {
 	return nil
 }
 
+// Updates the texts of a participant (or of a waitlisted participant), its code is kept
+func (activity *Activity) UpdateParticipant(code string, publicText string, privateText string) *Participant {
+	p := activity.GetParticipant(code)
+	if p == nil {
+		p = activity.GetWaitlisted(code)
+	}
+	if p != nil {
+		p.PublicText = publicText
+		p.PrivateText = privateText
+		p.UpdatedAt = time.Now()
+	}
+	return p
+}
+
+// Takes a participant (or a waitlisted participant) out of the activity without flagging it as deleted
+func (activity *Activity) TakeParticipant(code string) *Participant {
+	for k, p := range activity.Participants {
+		if p.Code == code {
+			activity.Participants = append(activity.Participants[:k], activity.Participants[k+1:]...)
+			return p
+		}
+	}
+	return activity.RemoveFromWaitlist(code)
+}
+
+// Moves a participant to the participants of another activity and records the move in the participant history
+func (activity *Activity) MoveParticipant(code string, target *Activity, by string) *Participant {
+	p := activity.TakeParticipant(code)
+	if p != nil {
+		p.History = append(p.History, &ParticipantMove{
+			From:    activity.Code,
+			To:      target.Code,
+			MovedAt: time.Now(),
+			MovedBy: by,
+		})
+		target.Participants = append(target.Participants, p)
+	}
+	return p
+}
+
 // Flags a participant as deleted
 func (activity *Activity) RemoveParticipant(code string) *Participant {
 	p := activity.GetParticipant(code)
@@ -70,25 +261,152 @@ func (activity *Activity) RemoveParticipant(code string) *Participant {
 	return p
 }
 
+// Physically removes participants and waiting list entries deleted before a date and returns them
+func (activity *Activity) PurgeParticipants(before time.Time) []*Participant {
+	purged := make([]*Participant, 0)
+	purge := func(participants []*Participant) []*Participant {
+		kept := make([]*Participant, 0, len(participants))
+		for _, participant := range participants {
+			if participant.DeletedAt.Before(before) {
+				purged = append(purged, participant)
+			} else {
+				kept = append(kept, participant)
+			}
+		}
+		return kept
+	}
+	activity.Participants = purge(activity.Participants)
+	activity.Waitlist = purge(activity.Waitlist)
+	return purged
+}
+
 // Removes activity data that should not been seen by non-admin users or users with another IP
 func (activity *Activity) RemovePrivateData(ip string) {
-	filteredParticipants := make([]*Participant, 0)
-	for _, participant := range activity.Participants {
-		if participant.DeletedAt.After(time.Now()) {
-			if ip != participant.CreatedBy {
-				participant.CreatedBy = ""
-				participant.PrivateText = ""
+	activity.RemovePrivateDataExcept(func(participant *Participant) bool {
+		return ip == participant.CreatedBy
+	})
+}
+
+// Removes activity data that should not been seen by non-admin users, except for the participants owned by the user
+func (activity *Activity) RemovePrivateDataExcept(isOwner func(participant *Participant) bool) {
+	filter := func(participants []*Participant) []*Participant {
+		filteredParticipants := make([]*Participant, 0)
+		for _, participant := range participants {
+			if participant.DeletedAt.After(time.Now()) {
+				if !isOwner(participant) {
+					participant.CreatedBy = ""
+					participant.PrivateText = ""
+					participant.Email = ""
+					participant.Answers = filterPublicAnswers(activity.Form, participant.Answers)
+					participant.History = nil
+				}
+				filteredParticipants = append(filteredParticipants, participant)
 			}
-			filteredParticipants = append(filteredParticipants, participant)
+		}
+		return filteredParticipants
+	}
+	activity.Participants = filter(activity.Participants)
+	activity.Waitlist = filter(activity.Waitlist)
+}
+
+// Returns the number of people represented by the participants which are not deleted
+func (activity *Activity) CountParticipants() int {
+	count := 0
+	now := time.Now()
+	for _, participant := range activity.Participants {
+		if participant.DeletedAt.After(now) {
+			count += participant.HeadCount()
 		}
 	}
-	activity.Participants = filteredParticipants
+	return count
+}
+
+// Returns true if the activity has reached its capacity
+func (activity *Activity) IsFull() bool {
+	return activity.Capacity > 0 && activity.CountParticipants() >= activity.Capacity
+}
+
+// Returns true if a group of headCount people can sign up without exceeding the capacity
+func (activity *Activity) HasRoomFor(headCount int) bool {
+	return activity.Capacity == 0 || activity.CountParticipants()+headCount <= activity.Capacity
+}
+
+// Closes a full activity, and reopens it when it is not full anymore if it was closed automatically and reopening is enabled
+func (activity *Activity) UpdateStateFromCapacity() {
+	if activity.IsFull() {
+		if activity.IsOpen() {
+			activity.State = StateClosed
+			activity.AutoClosed = true
+		}
+		return
+	}
+
+	if activity.AutoClosed && activity.ReopenWhenAvailable {
+		activity.State = StateOpen
+		activity.AutoClosed = false
+	}
 }
 
 // Returns if the state field has a valid value
 func (activity *Activity) IsStateValid() bool {
-	s := activity.State
-	return s == StateOpen || s == StateClosed
+	return IsValidState(activity.State)
+}
+
+// Returns true if an activity can have this state
+func IsValidState(s string) bool {
+	return s == StateOpen || s == StateClosed || s == StateDraft || s == StateArchived
+}
+
+// Returns true if the activity has this tag
+func (activity *Activity) HasTag(tag string) bool {
+	for _, t := range activity.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if state equals to "draft" (activity is not visible to the public)
+func (activity *Activity) IsDraft() bool {
+	return activity.State == StateDraft
+}
+
+// Returns true if state equals to "archived" (activity is read-only)
+func (activity *Activity) IsArchived() bool {
+	return activity.State == StateArchived
+}
+
+// Applies the scheduled opening and closing which are due and returns true if the activity has changed
+// An archived activity is never changed
+func (activity *Activity) ApplySchedule(now time.Time) bool {
+	if activity.IsArchived() {
+		return false
+	}
+
+	changed := false
+	if !activity.OpenAt.IsZero() && !now.Before(activity.OpenAt) {
+		if activity.State == StateDraft || activity.State == StateClosed {
+			activity.State = StateOpen
+			activity.AutoClosed = false
+		}
+		activity.OpenAt = time.Time{}
+		changed = true
+	}
+
+	if !activity.CloseAt.IsZero() && !now.Before(activity.CloseAt) {
+		if activity.IsOpen() || activity.AutoClosed {
+			activity.State = StateClosed
+			activity.AutoClosed = false
+		}
+		activity.CloseAt = time.Time{}
+		changed = true
+	}
+
+	if changed {
+		activity.UpdateStateFromCapacity()
+	}
+	return changed
 }
 
 // Returns true if state equals to "open"
@@ -96,6 +414,39 @@ func (activity *Activity) IsOpen() bool {
 	return activity.State == StateOpen
 }
 
+// Returns the number of people represented by a participant entry
+func (participant *Participant) HeadCount() int {
+	if participant.Count < 1 {
+		return 1
+	}
+	return participant.Count
+}
+
+// Creates a new participant with its code
+func newParticipant(publicText string, privateText string, ip string) *Participant {
+	p := &Participant{
+		PublicText:  publicText,
+		PrivateText: privateText,
+		CreatedAt:   time.Now(),
+		CreatedBy:   ip,
+		DeletedAt:   time.Now().AddDate(1, 0, 0),
+	}
+	p.Code = generateParticipantCode(p)
+	return p
+}
+
+// Computes the secret token of a participant, signed with the application secret
+func (participant *Participant) CancelToken(eventCode string, secret string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(eventCode + "/" + participant.Code))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Checks a participant token
+func (participant *Participant) IsTokenValid(token string, eventCode string, secret string) bool {
+	return hmac.Equal([]byte(token), []byte(participant.CancelToken(eventCode, secret)))
+}
+
 // Computes a participant code using a hash
 func generateParticipantCode(p *Participant) string {
 	h := sha256.New()
@@ -1,6 +1,7 @@
 package entities
 
 import (
+	"strings"
 	"testing"
 	"time"
 
@@ -62,6 +63,11 @@ func TestRemovePrivateData_deleted(t *testing.T) {
 	activity.RemovePrivateData("IP")
 
 	assert.Len(t, activity.Participants, 0, "Wrong participant count, only admin could see deleted participants")
+
+	w := activity.AddToWaitlist("some public text", "some private text", "IP")
+	w.DeletedAt = time.Now()
+	activity.RemovePrivateData("IP")
+	assert.Len(t, activity.Waitlist, 0, "Wrong waiting list count, only admin could see deleted participants")
 }
 
 // Ensure participant see its data (same IP)
@@ -97,4 +103,275 @@ func TestStateValidation(t *testing.T) {
 	activity := NewActivity("code_test")
 	activity.State = "other"
 	assert.False(t, activity.IsStateValid())
+
+	for _, state := range []string{StateOpen, StateClosed, StateDraft, StateArchived} {
+		activity.State = state
+		assert.True(t, activity.IsStateValid())
+	}
+}
+
+// Ensure only participants deleted before the given date are purged
+func TestPurgeParticipants(t *testing.T) {
+	activity := NewActivity("code_test")
+	p0 := activity.AddParticipant("some public text 0", "some private text 0", "IP 0")
+	p1 := activity.AddParticipant("some public text 1", "some private text 1", "IP 1")
+	p2 := activity.AddParticipant("some public text 2", "some private text 2", "IP 2")
+	w0 := activity.AddToWaitlist("some public text 3", "some private text 3", "IP 3")
+	w1 := activity.AddToWaitlist("some public text 4", "some private text 4", "IP 4")
+	p0.DeletedAt = time.Now().AddDate(0, -2, 0)
+	p1.DeletedAt = time.Now().AddDate(0, 0, -1)
+	w0.DeletedAt = time.Now().AddDate(0, -2, 0)
+
+	purged := activity.PurgeParticipants(time.Now().AddDate(0, -1, 0))
+	assert.Len(t, purged, 2)
+	assert.Equal(t, p0.Code, purged[0].Code)
+	assert.Equal(t, w0.Code, purged[1].Code)
+	assert.Len(t, activity.Participants, 2)
+	assert.Nil(t, activity.GetParticipant(p0.Code))
+	assert.Len(t, activity.Waitlist, 1)
+	assert.NotNil(t, activity.GetWaitlisted(w1.Code))
+
+	purged = activity.PurgeParticipants(time.Now())
+	assert.Len(t, purged, 1)
+	assert.Equal(t, p1.Code, purged[0].Code)
+	assert.Len(t, activity.Participants, 1)
+	assert.NotNil(t, activity.GetParticipant(p2.Code))
+}
+
+// Ensure activity details validation works
+func TestActivityDetailsValidation(t *testing.T) {
+	start := time.Date(2017, 6, 24, 14, 0, 0, 0, time.UTC)
+	details := &ActivityDetails{Title: "Bar", StartAt: start, EndAt: start.Add(2 * time.Hour), Order: 1}
+	assert.NoError(t, details.Validate())
+
+	details.EndAt = start.Add(-time.Hour)
+	assert.Error(t, details.Validate())
+
+	details = &ActivityDetails{EndAt: start}
+	assert.NoError(t, details.Validate())
+
+	details = &ActivityDetails{Title: strings.Repeat("a", MaxTitleLength+1)}
+	assert.Error(t, details.Validate())
+
+	details = &ActivityDetails{Description: strings.Repeat("a", MaxDescriptionLength+1)}
+	assert.Error(t, details.Validate())
+
+	details = &ActivityDetails{Location: strings.Repeat("a", MaxLocationLength+1)}
+	assert.Error(t, details.Validate())
+
+	details = &ActivityDetails{Order: -1}
+	assert.EqualError(t, details.Validate(), "Order must not be negative")
+
+	details = &ActivityDetails{Order: 0}
+	assert.NoError(t, details.Validate())
+}
+
+// Ensure an activity is closed when full and reopened only if it was closed automatically
+func TestCapacity(t *testing.T) {
+	activity := NewActivity("code_test")
+	assert.False(t, activity.IsFull())
+
+	activity.Capacity = 2
+	p0 := activity.AddParticipant("some public text 0", "some private text 0", "IP 0")
+	activity.UpdateStateFromCapacity()
+	assert.True(t, activity.IsOpen())
+
+	activity.AddParticipant("some public text 1", "some private text 1", "IP 1")
+	activity.UpdateStateFromCapacity()
+	assert.True(t, activity.IsFull())
+	assert.False(t, activity.IsOpen())
+	assert.True(t, activity.AutoClosed)
+
+	// Deleted participants are not counted, reopening is disabled
+	activity.RemoveParticipant(p0.Code)
+	assert.Equal(t, 1, activity.CountParticipants())
+	activity.UpdateStateFromCapacity()
+	assert.False(t, activity.IsOpen())
+
+	activity.ReopenWhenAvailable = true
+	activity.UpdateStateFromCapacity()
+	assert.True(t, activity.IsOpen())
+	assert.False(t, activity.AutoClosed)
+
+	// A manually closed activity stays closed
+	activity.State = StateClosed
+	activity.UpdateStateFromCapacity()
+	assert.False(t, activity.IsOpen())
+}
+
+// Ensure waitlisted participants are promoted in order while there are free places
+func TestWaitlist(t *testing.T) {
+	activity := NewActivity("code_test")
+	activity.Capacity = 1
+	activity.WaitlistEnabled = true
+	assert.False(t, activity.IsWaitlistOpen())
+
+	p0 := activity.AddParticipant("some public text 0", "some private text 0", "IP 0")
+	activity.UpdateStateFromCapacity()
+	assert.True(t, activity.IsWaitlistOpen())
+
+	w1 := activity.AddToWaitlist("some public text 1", "some private text 1", "IP 1")
+	w2 := activity.AddToWaitlist("some public text 2", "some private text 2", "IP 2")
+	w3 := activity.AddToWaitlist("some public text 3", "some private text 3", "IP 3")
+	assert.Len(t, activity.Waitlist, 3)
+	assert.Equal(t, w2, activity.GetWaitlisted(w2.Code))
+	assert.Len(t, activity.PromoteFromWaitlist(), 0)
+
+	assert.Equal(t, w2, activity.RemoveFromWaitlist(w2.Code))
+	assert.Nil(t, activity.RemoveFromWaitlist(w2.Code))
+
+	activity.RemoveParticipant(p0.Code)
+	promoted := activity.PromoteFromWaitlist()
+	assert.Len(t, promoted, 1)
+	assert.Equal(t, w1.Code, promoted[0].Code)
+	assert.NotNil(t, activity.GetParticipant(w1.Code))
+	assert.Len(t, activity.Waitlist, 1)
+
+	activity.Capacity = 5
+	promoted = activity.PromoteFromWaitlist()
+	assert.Len(t, promoted, 1)
+	assert.Equal(t, w3.Code, promoted[0].Code)
+	assert.Len(t, activity.Waitlist, 0)
+
+	// A manually closed activity has no waiting list
+	activity.Capacity = 1
+	activity.State = StateClosed
+	activity.AutoClosed = false
+	assert.False(t, activity.IsWaitlistOpen())
+}
+
+// Ensure groups are counted with their head count
+func TestHeadCount(t *testing.T) {
+	activity := NewActivity("code_test")
+	activity.Capacity = 5
+
+	p0 := activity.AddParticipant("family", "some private text 0", "IP 0")
+	p0.Count = 3
+	activity.AddParticipant("alone", "some private text 1", "IP 1")
+	assert.Equal(t, 1, activity.Participants[1].HeadCount())
+	assert.Equal(t, 4, activity.CountParticipants())
+	assert.True(t, activity.HasRoomFor(1))
+	assert.False(t, activity.HasRoomFor(2))
+	assert.False(t, activity.IsFull())
+
+	// First waitlisted group does not fit, nobody is promoted before it
+	w0 := activity.AddToWaitlist("big family", "some private text 2", "IP 2")
+	w0.Count = 4
+	activity.AddToWaitlist("alone", "some private text 3", "IP 3")
+	assert.Len(t, activity.PromoteFromWaitlist(), 0)
+
+	activity.RemoveParticipant(p0.Code)
+	promoted := activity.PromoteFromWaitlist()
+	assert.Len(t, promoted, 1)
+	assert.Equal(t, w0.Code, promoted[0].Code)
+	assert.Equal(t, 5, activity.CountParticipants())
+	assert.True(t, activity.IsFull())
+}
+
+// Ensure scheduled transitions are applied once when due
+func TestApplySchedule(t *testing.T) {
+	now := time.Date(2017, 6, 19, 20, 0, 0, 0, time.UTC)
+	activity := NewActivity("code_test")
+	activity.State = StateDraft
+	activity.OpenAt = now
+	activity.CloseAt = now.Add(24 * time.Hour)
+
+	assert.False(t, activity.ApplySchedule(now.Add(-time.Minute)))
+	assert.True(t, activity.IsDraft())
+
+	assert.True(t, activity.ApplySchedule(now))
+	assert.True(t, activity.IsOpen())
+	assert.True(t, activity.OpenAt.IsZero())
+
+	// Manual closing is not overridden by an already applied opening
+	activity.State = StateClosed
+	assert.False(t, activity.ApplySchedule(now.Add(time.Hour)))
+	assert.False(t, activity.IsOpen())
+
+	activity.State = StateOpen
+	assert.True(t, activity.ApplySchedule(now.Add(24*time.Hour)))
+	assert.Equal(t, StateClosed, activity.State)
+	assert.True(t, activity.CloseAt.IsZero())
+
+	// Archived activities are never changed
+	activity.State = StateArchived
+	activity.OpenAt = now
+	assert.False(t, activity.ApplySchedule(now.Add(48*time.Hour)))
+	assert.True(t, activity.IsArchived())
+
+	// Opening a full activity closes it automatically
+	activity = NewActivity("code_test")
+	activity.State = StateClosed
+	activity.Capacity = 1
+	activity.AddParticipant("some public text", "some private text", "IP")
+	activity.OpenAt = now
+	assert.True(t, activity.ApplySchedule(now))
+	assert.Equal(t, StateClosed, activity.State)
+	assert.True(t, activity.AutoClosed)
+}
+
+// Ensure a participant update keeps its code and its position
+func TestUpdateParticipant(t *testing.T) {
+	activity := NewActivity("code_test")
+	p0 := activity.AddParticipant("typo", "some private text 0", "IP 0")
+	activity.AddParticipant("some public text 1", "some private text 1", "IP 1")
+	w := activity.AddToWaitlist("some public text 2", "some private text 2", "IP 2")
+
+	assert.Nil(t, activity.UpdateParticipant("unknown", "public", "private"))
+
+	p := activity.UpdateParticipant(p0.Code, "fixed", "private")
+	assert.Equal(t, p0.Code, p.Code)
+	assert.Equal(t, "fixed", activity.Participants[0].PublicText)
+	assert.Equal(t, "private", activity.Participants[0].PrivateText)
+	assert.False(t, activity.Participants[0].UpdatedAt.IsZero())
+	assert.True(t, activity.Participants[1].UpdatedAt.IsZero())
+
+	activity.UpdateParticipant(w.Code, "waiting", "private")
+	assert.Equal(t, "waiting", activity.Waitlist[0].PublicText)
+}
+
+func TestMoveParticipant(t *testing.T) {
+	source := NewActivity("source")
+	target := NewActivity("target")
+	p0 := source.AddParticipant("some public text 0", "some private text 0", "IP 0")
+	w := source.AddToWaitlist("some public text 1", "some private text 1", "IP 1")
+
+	assert.Nil(t, source.MoveParticipant("unknown", target, "admin"))
+
+	p := source.MoveParticipant(p0.Code, target, "admin")
+	assert.Equal(t, p0.Code, p.Code)
+	assert.Len(t, source.Participants, 0)
+	assert.Len(t, target.Participants, 1)
+	assert.True(t, target.Participants[0].DeletedAt.After(time.Now()))
+	assert.Len(t, p.History, 1)
+	assert.Equal(t, "source", p.History[0].From)
+	assert.Equal(t, "target", p.History[0].To)
+	assert.Equal(t, "admin", p.History[0].MovedBy)
+
+	source.MoveParticipant(w.Code, target, "admin")
+	assert.Len(t, source.Waitlist, 0)
+	assert.Len(t, target.Participants, 2)
+
+	target.RemovePrivateData("IP 1")
+	assert.Nil(t, target.Participants[0].History)
+	assert.Len(t, target.Participants[1].History, 1)
+}
+
+func TestCancelToken(t *testing.T) {
+	activity := NewActivity("code_test")
+	p0 := activity.AddParticipant("some public text 0", "some private text 0", "IP")
+	p1 := activity.AddParticipant("some public text 1", "some private text 1", "IP")
+
+	token := p0.CancelToken("event", "secret")
+	assert.True(t, p0.IsTokenValid(token, "event", "secret"))
+	assert.False(t, p0.IsTokenValid(token, "other event", "secret"))
+	assert.False(t, p0.IsTokenValid(token, "event", "other secret"))
+	assert.False(t, p1.IsTokenValid(token, "event", "secret"))
+	assert.False(t, p0.IsTokenValid("", "event", "secret"))
+
+	activity.RemovePrivateDataExcept(func(participant *Participant) bool {
+		return participant.IsTokenValid(token, "event", "secret")
+	})
+	assert.Equal(t, "some private text 0", activity.Participants[0].PrivateText)
+	assert.Empty(t, activity.Participants[1].PrivateText)
 }
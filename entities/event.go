@@ -1,10 +1,14 @@
 package entities
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -19,8 +23,25 @@ type Event struct {
 	CreatedBy      string
 	UserEmail      string
 	EmailConfirmed bool
-	AdminPassword  string
+	AdminPassword  string // bcrypt hash of the admin password
 	Config         []byte
+	Revision       int // Revision of the config, changed when the config is set
+
+	// Changed each time a login link is used, so that login links can only be used once
+	LoginNonce string
+
+	// Co-organizers, with their own account
+	Organizers []*Organizer
+
+	// Clear text admin password, only known when it has just been generated (never saved)
+	Password string `json:"-"`
+}
+
+// Tombstone remembers a deleted event code so that it is not reused too early
+type Tombstone struct {
+	Code      string
+	DeletedAt time.Time
+	DeletedBy string
 }
 
 // Creates a new pending confirmation event
@@ -47,9 +68,70 @@ func NewPendingConfirmationEvent(code string, ip string, userEmail string) (*Eve
 	}, nil
 }
 
+// IsExpired returns true if the event is still waiting for its confirmation after the given delay (0 means never)
+func (event *Event) IsExpired(pendingExpiry time.Duration) bool {
+	return !event.EmailConfirmed && pendingExpiry > 0 && time.Since(event.CreatedAt) > pendingExpiry
+}
+
 func (event *Event) ConfirmCode(secret string) string {
 	h := sha256.New()
 	h.Write([]byte(event.Code + event.UserEmail + secret))
 	hashBytes := h.Sum(nil)
 	return hex.EncodeToString(hashBytes[:])
 }
+
+// LoginCode returns a signed code allowing to log in as the event admin until expiresAt
+func (event *Event) LoginCode(secret string, expiresAt time.Time) string {
+	return signLoginCode(event.Code, event.LoginNonce, secret, expiresAt.Unix())
+}
+
+// ConsumeLoginCode checks a login code and, if valid, invalidates all the login codes already given
+func (event *Event) ConsumeLoginCode(code string, secret string, now time.Time) bool {
+	if !checkLoginCode(code, event.Code, event.LoginNonce, secret, now) {
+		return false
+	}
+	event.LoginNonce = newNonce()
+	return true
+}
+
+// RemoveSecrets removes the password hashes and login nonces before sending an event to a client
+func (event *Event) RemoveSecrets() {
+	event.AdminPassword = ""
+	event.LoginNonce = ""
+	for _, organizer := range event.Organizers {
+		organizer.PasswordHash = ""
+		organizer.LoginNonce = ""
+		organizer.SessionNonce = ""
+	}
+}
+
+// signLoginCode returns a login code for the subject (an event or an organizer), valid until expiry
+func signLoginCode(subject string, nonce string, secret string, expiry int64) string {
+	expiryText := strconv.FormatInt(expiry, 10)
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(subject + "/" + expiryText + "/" + nonce))
+	return expiryText + "-" + hex.EncodeToString(h.Sum(nil))
+}
+
+// checkLoginCode returns true if the code is a login code of the subject which has not expired
+func checkLoginCode(code string, subject string, nonce string, secret string, now time.Time) bool {
+	parts := strings.SplitN(code, "-", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || now.Unix() > expiry {
+		return false
+	}
+
+	return hmac.Equal([]byte(code), []byte(signLoginCode(subject, nonce, secret, expiry)))
+}
+
+func newNonce() string {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(nonce)
+}
@@ -1,6 +1,8 @@
 package entities
 
 import (
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -43,3 +45,36 @@ func TestConfirmationCode(t *testing.T) {
 	assert.NotEqual(t, event.ConfirmCode("secret"), event3.ConfirmCode("secret"))
 
 }
+
+func TestEventExpiry(t *testing.T) {
+	event, _ := NewPendingConfirmationEvent("code_test", "ip", "email@email.com")
+	assert.False(t, event.IsExpired(time.Hour))
+
+	event.CreatedAt = time.Now().Add(-2 * time.Hour)
+	assert.True(t, event.IsExpired(time.Hour))
+	assert.False(t, event.IsExpired(0))
+
+	event.EmailConfirmed = true
+	assert.False(t, event.IsExpired(time.Hour))
+}
+
+func TestLoginCode(t *testing.T) {
+	event, _ := NewPendingConfirmationEvent("testevent", "ip", "test@test.com")
+	now := time.Now()
+
+	code := event.LoginCode("secret", now.Add(time.Hour))
+	assert.False(t, event.ConsumeLoginCode(code, "other secret", now))
+	assert.False(t, event.ConsumeLoginCode(code, "secret", now.Add(2*time.Hour)))
+	assert.False(t, event.ConsumeLoginCode("invalid", "secret", now))
+	assert.False(t, event.ConsumeLoginCode(strconv.FormatInt(now.Add(48*time.Hour).Unix(), 10)+code[strings.Index(code, "-"):], "secret", now))
+
+	other, _ := NewPendingConfirmationEvent("otherevent", "ip", "test@test.com")
+	assert.False(t, other.ConsumeLoginCode(code, "secret", now))
+
+	// Codes can only be used once
+	otherCode := event.LoginCode("secret", now.Add(time.Hour))
+	assert.True(t, event.ConsumeLoginCode(code, "secret", now))
+	assert.False(t, event.ConsumeLoginCode(code, "secret", now))
+	assert.False(t, event.ConsumeLoginCode(otherCode, "secret", now))
+	assert.True(t, event.ConsumeLoginCode(event.LoginCode("secret", now.Add(time.Hour)), "secret", now))
+}
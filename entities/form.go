@@ -0,0 +1,176 @@
+package entities
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+)
+
+const (
+	FieldText     = "text"
+	FieldPhone    = "phone"
+	FieldEmail    = "email"
+	FieldNumber   = "number"
+	FieldSelect   = "select"
+	FieldCheckbox = "checkbox"
+
+	MaxFormFields       = 30
+	MaxFieldOptions     = 50
+	MaxFieldLabelLength = 200
+	MaxAnswerLength     = 500
+	FieldNameRegExp     = "^[A-Za-z0-9_-]{1,50}$"
+	PhoneRegExp         = "^\\+?[0-9 .()-]{6,20}$"
+)
+
+// FormField is a question asked to the participants of an activity
+type FormField struct {
+	Name     string   `json:"name"`
+	Label    string   `json:"label"`
+	Type     string   `json:"type"`
+	Required bool     `json:"required"`
+	Public   bool     `json:"public"`
+	Options  []string `json:"options"`
+}
+
+// Checks a form definition
+func ValidateForm(fields []*FormField) error {
+	if len(fields) > MaxFormFields {
+		return errors.New("Too many form fields")
+	}
+
+	nameValidator, _ := regexp.Compile(FieldNameRegExp)
+	names := make(map[string]bool)
+	for _, field := range fields {
+		if !nameValidator.MatchString(field.Name) {
+			return errors.New("Invalid form field name")
+		}
+		if names[field.Name] {
+			return errors.New("Duplicate form field " + field.Name)
+		}
+		names[field.Name] = true
+
+		if len(field.Label) > MaxFieldLabelLength {
+			return errors.New("Form field label is too long")
+		}
+
+		switch field.Type {
+		case FieldText, FieldPhone, FieldEmail, FieldNumber, FieldCheckbox:
+		case FieldSelect:
+			if len(field.Options) == 0 || len(field.Options) > MaxFieldOptions {
+				return errors.New("Invalid options for form field " + field.Name)
+			}
+		default:
+			return errors.New("Invalid type for form field " + field.Name)
+		}
+	}
+	return nil
+}
+
+// Checks the answers of a participant against a form
+func ValidateAnswers(fields []*FormField, answers map[string]string) error {
+	known := make(map[string]bool)
+	for _, field := range fields {
+		known[field.Name] = true
+
+		// A required checkbox has to be checked
+		answer := answers[field.Name]
+		if field.Required && (answer == "" || (field.Type == FieldCheckbox && answer == "false")) {
+			return errors.New("Field " + field.Name + " is required")
+		}
+		if answer == "" {
+			continue
+		}
+
+		if err := field.validateAnswer(answer); err != nil {
+			return err
+		}
+	}
+
+	for name := range answers {
+		if !known[name] {
+			return errors.New("Unknown field " + name)
+		}
+	}
+	return nil
+}
+
+// Checks an answer against the field type
+func (field *FormField) validateAnswer(answer string) error {
+	if len(answer) > MaxAnswerLength {
+		return errors.New("Field " + field.Name + " is too long")
+	}
+
+	valid := true
+	switch field.Type {
+	case FieldPhone:
+		valid, _ = regexp.MatchString(PhoneRegExp, answer)
+	case FieldEmail:
+		valid, _ = regexp.MatchString(EmailRegExp, answer)
+	case FieldNumber:
+		_, err := strconv.ParseFloat(answer, 64)
+		valid = err == nil
+	case FieldCheckbox:
+		valid = answer == "true" || answer == "false"
+	case FieldSelect:
+		valid = false
+		for _, option := range field.Options {
+			if answer == option {
+				valid = true
+			}
+		}
+	}
+
+	if !valid {
+		return errors.New("Invalid value for field " + field.Name)
+	}
+	return nil
+}
+
+// Checks the answers of a participant moved from an activity to another one
+// The answers have to be valid for the target form, and a private answer can't become public
+func ValidateMovedAnswers(from []*FormField, to []*FormField, answers map[string]string) error {
+	if err := ValidateAnswers(to, answers); err != nil {
+		return err
+	}
+
+	public := make(map[string]bool)
+	for _, field := range from {
+		public[field.Name] = field.Public
+	}
+	for _, field := range to {
+		if _, ok := answers[field.Name]; ok && field.Public && !public[field.Name] {
+			return errors.New("Field " + field.Name + " is private and would become public")
+		}
+	}
+	return nil
+}
+
+// Checks that the answers already given stay valid with a new form of the activity
+// Answers given to a private field can't become public, removed fields and options are rejected
+func (activity *Activity) ValidateFormChange(form []*FormField) error {
+	for _, participants := range [][]*Participant{activity.Participants, activity.Waitlist} {
+		for _, participant := range participants {
+			if len(participant.Answers) == 0 {
+				continue
+			}
+			if err := ValidateMovedAnswers(activity.Form, form, participant.Answers); err != nil {
+				return errors.New("Form does not match the answers already given : " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// Removes the answers to the private fields
+func filterPublicAnswers(fields []*FormField, answers map[string]string) map[string]string {
+	if answers == nil {
+		return nil
+	}
+	public := make(map[string]string)
+	for _, field := range fields {
+		if answer, ok := answers[field.Name]; ok && field.Public {
+			public[field.Name] = answer
+		}
+	}
+	return public
+}
@@ -0,0 +1,108 @@
+package entities
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeTestForm() []*FormField {
+	return []*FormField{
+		{Name: "phone", Type: FieldPhone, Required: true},
+		{Name: "email", Type: FieldEmail},
+		{Name: "adults", Type: FieldNumber},
+		{Name: "size", Type: FieldSelect, Options: []string{"S", "M", "L"}, Public: true},
+		{Name: "agree", Type: FieldCheckbox, Required: true},
+		{Name: "comment", Type: FieldText},
+	}
+}
+
+// Ensure invalid forms are rejected
+func TestValidateForm(t *testing.T) {
+	assert.NoError(t, ValidateForm(nil))
+	assert.NoError(t, ValidateForm(makeTestForm()))
+
+	assert.Error(t, ValidateForm([]*FormField{{Name: "", Type: FieldText}}))
+	assert.Error(t, ValidateForm([]*FormField{{Name: "a b", Type: FieldText}}))
+	assert.Error(t, ValidateForm([]*FormField{{Name: "a", Type: "date"}}))
+	assert.Error(t, ValidateForm([]*FormField{{Name: "a", Type: FieldSelect}}))
+	assert.Error(t, ValidateForm([]*FormField{{Name: "a", Type: FieldText}, {Name: "a", Type: FieldNumber}}))
+}
+
+// Ensure answers are checked against the form
+func TestValidateAnswers(t *testing.T) {
+	form := makeTestForm()
+	valid := map[string]string{"phone": "+33 6 00 00 00 00", "size": "M", "agree": "true"}
+	assert.NoError(t, ValidateAnswers(form, valid))
+	assert.NoError(t, ValidateAnswers(nil, nil))
+
+	invalids := []map[string]string{
+		{"size": "M", "agree": "true"},
+		{"phone": "0600000000", "agree": "false"},
+		{"phone": "not a phone", "agree": "true"},
+		{"phone": "0600000000", "agree": "true", "email": "test"},
+		{"phone": "0600000000", "agree": "true", "adults": "two"},
+		{"phone": "0600000000", "agree": "true", "size": "XXL"},
+		{"phone": "0600000000", "agree": "yes"},
+		{"phone": "0600000000", "agree": "true", "unknown": "value"},
+	}
+	for _, answers := range invalids {
+		assert.Error(t, ValidateAnswers(form, answers), "%v", answers)
+	}
+}
+
+// Ensure moved answers are valid for the target form and stay private
+func TestValidateMovedAnswers(t *testing.T) {
+	form := makeTestForm()
+	answers := map[string]string{"phone": "0600000000", "size": "M", "agree": "true"}
+	assert.NoError(t, ValidateMovedAnswers(form, form, answers))
+	assert.NoError(t, ValidateMovedAnswers(nil, nil, nil))
+
+	// Required field is missing in the target form
+	target := append(makeTestForm(), &FormField{Name: "age", Type: FieldNumber, Required: true})
+	assert.Error(t, ValidateMovedAnswers(form, target, answers))
+
+	// Phone is public in the target form
+	target = makeTestForm()
+	target[0].Public = true
+	assert.Error(t, ValidateMovedAnswers(form, target, answers))
+
+	// Unknown field in the target form
+	assert.Error(t, ValidateMovedAnswers(form, nil, answers))
+}
+
+// Ensure a form change keeps the answers already given valid and private
+func TestValidateFormChange(t *testing.T) {
+	activity := NewActivity("code_test")
+	activity.Form = makeTestForm()
+	assert.NoError(t, activity.ValidateFormChange(nil))
+
+	p := activity.AddToWaitlist("some public text", "some private text", "IP")
+	p.Answers = map[string]string{"phone": "0600000000", "size": "M", "agree": "true"}
+	activity.AddParticipant("without answers", "", "IP")
+	assert.NoError(t, activity.ValidateFormChange(makeTestForm()))
+
+	// Phone becomes public
+	form := makeTestForm()
+	form[0].Public = true
+	assert.Error(t, activity.ValidateFormChange(form))
+
+	// Size option is removed
+	form = makeTestForm()
+	form[3].Options = []string{"S", "L"}
+	assert.Error(t, activity.ValidateFormChange(form))
+
+	// Field with an answer is removed
+	assert.Error(t, activity.ValidateFormChange(makeTestForm()[1:]))
+}
+
+// Ensure private answers are hidden from other users
+func TestRemovePrivateAnswers(t *testing.T) {
+	activity := NewActivity("code_test")
+	activity.Form = makeTestForm()
+	p := activity.AddParticipant("some public text", "some private text", "IP")
+	p.Answers = map[string]string{"phone": "0600000000", "size": "M", "agree": "true"}
+
+	activity.RemovePrivateData("other IP")
+	assert.Equal(t, map[string]string{"size": "M"}, activity.Participants[0].Answers)
+}
@@ -0,0 +1,144 @@
+package entities
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	MaxOrganizers = 20
+
+	// Organizer roles
+	RoleOwner   = "owner"   // Everything
+	RoleManager = "manager" // Edit activities and move participants
+	RoleViewer  = "viewer"  // Read private data only
+	RoleLead    = "lead"    // Manage the participants of its activities
+)
+
+// Organizer is an individual account allowed to manage an event
+type Organizer struct {
+	Email        string
+	PasswordHash string // bcrypt hash, empty until the organizer chooses a password
+	InvitedAt    time.Time
+	InvitedBy    string
+	LoginNonce   string
+	SessionNonce string // Bound to the tokens of the organizer, a new invitation gets a new one
+	Role         string
+	Activities   []string // Codes of the activities led (activity lead only)
+}
+
+// Returns true if the role exists
+func IsValidRole(role string) bool {
+	return role == RoleOwner || role == RoleManager || role == RoleViewer || role == RoleLead
+}
+
+// Returns the organizer role, organizers invited before roles existed are owners
+func (organizer *Organizer) GetRole() string {
+	if organizer.Role == "" {
+		return RoleOwner
+	}
+	return organizer.Role
+}
+
+// Changes the organizer role, an activity lead manages a single activity
+func (organizer *Organizer) SetRole(role string, activities []string) error {
+	if role == "" {
+		role = RoleOwner
+	}
+
+	if !IsValidRole(role) {
+		return errors.New("Invalid role")
+	}
+
+	if role != RoleLead {
+		activities = nil
+	} else if len(activities) != 1 {
+		return errors.New("An activity lead manages a single activity")
+	} else if valid, _ := regexp.MatchString(ActivityCodeRegExp, activities[0]); !valid {
+		return errors.New("Invalid activity code " + activities[0])
+	}
+
+	organizer.Role = role
+	organizer.Activities = activities
+	return nil
+}
+
+// Returns true if the organizer is a lead of the activity
+func (organizer *Organizer) LeadsActivity(activityCode string) bool {
+	if organizer.GetRole() != RoleLead {
+		return false
+	}
+	for _, code := range organizer.Activities {
+		if code == activityCode {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns an organizer of the event by email (case insensitive)
+func (event *Event) GetOrganizer(email string) *Organizer {
+	email = strings.ToLower(email)
+	for _, organizer := range event.Organizers {
+		if organizer.Email == email {
+			return organizer
+		}
+	}
+	return nil
+}
+
+// Adds an organizer to the event with the given role (owner if empty)
+func (event *Event) AddOrganizer(email string, invitedBy string, role string, activities []string) (*Organizer, error) {
+	emailValidator, _ := regexp.Compile(EmailRegExp)
+	if !emailValidator.MatchString(email) {
+		return nil, errors.New("Invalid email")
+	}
+
+	if event.GetOrganizer(email) != nil {
+		return nil, errors.New("Organizer already exists")
+	}
+
+	if len(event.Organizers) >= MaxOrganizers {
+		return nil, errors.New("Number of organizers has reach the limit")
+	}
+
+	organizer := &Organizer{
+		Email:        strings.ToLower(email),
+		InvitedAt:    time.Now(),
+		InvitedBy:    invitedBy,
+		SessionNonce: newNonce(),
+	}
+	if err := organizer.SetRole(role, activities); err != nil {
+		return nil, err
+	}
+	event.Organizers = append(event.Organizers, organizer)
+	return organizer, nil
+}
+
+// Removes an organizer from the event, returns false if there is no such organizer
+func (event *Event) RemoveOrganizer(email string) bool {
+	email = strings.ToLower(email)
+	for k, organizer := range event.Organizers {
+		if organizer.Email == email {
+			event.Organizers = append(event.Organizers[:k], event.Organizers[k+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// LoginCode returns a signed code allowing the organizer to log in until expiresAt
+func (organizer *Organizer) LoginCode(eventCode string, secret string, expiresAt time.Time) string {
+	return signLoginCode(eventCode+"/"+organizer.Email, organizer.LoginNonce, secret, expiresAt.Unix())
+}
+
+// ConsumeLoginCode checks a login code and, if valid, invalidates all the login codes already given to the organizer
+func (organizer *Organizer) ConsumeLoginCode(eventCode string, code string, secret string, now time.Time) bool {
+	if !checkLoginCode(code, eventCode+"/"+organizer.Email, organizer.LoginNonce, secret, now) {
+		return false
+	}
+	organizer.LoginNonce = newNonce()
+	return true
+}
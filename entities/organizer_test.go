@@ -0,0 +1,92 @@
+package entities
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrganizers(t *testing.T) {
+	event, _ := NewPendingConfirmationEvent("testevent", "ip", "test@test.com")
+
+	_, err := event.AddOrganizer("not an email", "testevent-admin", "", nil)
+	assert.Error(t, err)
+
+	organizer, err := event.AddOrganizer("Alice@School.org", "testevent-admin", "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice@school.org", organizer.Email)
+	assert.Equal(t, "testevent-admin", organizer.InvitedBy)
+
+	_, err = event.AddOrganizer("alice@school.org", "testevent-admin", "", nil)
+	assert.Error(t, err)
+
+	assert.Equal(t, organizer, event.GetOrganizer("ALICE@school.org"))
+	assert.Nil(t, event.GetOrganizer("bob@school.org"))
+
+	assert.False(t, event.RemoveOrganizer("bob@school.org"))
+	assert.True(t, event.RemoveOrganizer("alice@school.org"))
+	assert.Len(t, event.Organizers, 0)
+
+	// Invited again, the organizer gets a new session nonce
+	invitedAgain, err := event.AddOrganizer("alice@school.org", "testevent-admin", "", nil)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, invitedAgain.SessionNonce)
+	assert.NotEqual(t, organizer.SessionNonce, invitedAgain.SessionNonce)
+	assert.True(t, event.RemoveOrganizer("alice@school.org"))
+
+	for i := 0; i < MaxOrganizers; i++ {
+		_, err = event.AddOrganizer("organizer"+string(rune('a'+i))+"@school.org", "testevent-admin", "", nil)
+		assert.NoError(t, err)
+	}
+	_, err = event.AddOrganizer("onemore@school.org", "testevent-admin", "", nil)
+	assert.Error(t, err)
+}
+
+func TestOrganizerLoginCode(t *testing.T) {
+	event, _ := NewPendingConfirmationEvent("testevent", "ip", "test@test.com")
+	alice, _ := event.AddOrganizer("alice@school.org", "testevent-admin", "", nil)
+	bob, _ := event.AddOrganizer("bob@school.org", "testevent-admin", "", nil)
+	now := time.Now()
+
+	code := alice.LoginCode("testevent", "secret", now.Add(time.Hour))
+	assert.False(t, bob.ConsumeLoginCode("testevent", code, "secret", now))
+	assert.False(t, event.ConsumeLoginCode(code, "secret", now))
+	assert.False(t, alice.ConsumeLoginCode("otherevent", code, "secret", now))
+	assert.True(t, alice.ConsumeLoginCode("testevent", code, "secret", now))
+	assert.False(t, alice.ConsumeLoginCode("testevent", code, "secret", now))
+
+	alice.PasswordHash = "hash"
+	event.RemoveSecrets()
+	assert.Empty(t, alice.PasswordHash)
+	assert.Empty(t, alice.LoginNonce)
+}
+
+func TestOrganizerRoles(t *testing.T) {
+	event, _ := NewPendingConfirmationEvent("testevent", "ip", "test@test.com")
+
+	_, err := event.AddOrganizer("alice@school.org", "testevent-admin", "king", nil)
+	assert.Error(t, err)
+
+	_, err = event.AddOrganizer("alice@school.org", "testevent-admin", RoleLead, nil)
+	assert.Error(t, err)
+	_, err = event.AddOrganizer("alice@school.org", "testevent-admin", RoleLead, []string{"bar", "cakes"})
+	assert.Error(t, err)
+	_, err = event.AddOrganizer("alice@school.org", "testevent-admin", RoleLead, []string{"not a code"})
+	assert.Error(t, err)
+	assert.Len(t, event.Organizers, 0)
+
+	alice, err := event.AddOrganizer("alice@school.org", "testevent-admin", RoleLead, []string{"bar"})
+	assert.NoError(t, err)
+	assert.True(t, alice.LeadsActivity("bar"))
+	assert.False(t, alice.LeadsActivity("cakes"))
+
+	assert.NoError(t, alice.SetRole(RoleViewer, []string{"bar"}))
+	assert.Equal(t, RoleViewer, alice.GetRole())
+	assert.Nil(t, alice.Activities)
+	assert.False(t, alice.LeadsActivity("bar"))
+
+	// Organizers invited before roles existed are owners
+	alice.Role = ""
+	assert.Equal(t, RoleOwner, alice.GetRole())
+}
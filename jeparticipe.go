@@ -5,29 +5,98 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/julienbayle/jeparticipe/app"
+	"github.com/julienbayle/jeparticipe/services"
 )
 
 func main() {
 
 	var (
-		// Path to the database
-		dbFile = flag.String("db", "jeparticipe.db", "Path to the BoltDB file")
+		// Database URL
+		dbUrl = flag.String("db", "jeparticipe.db", "Database URL (bolt://file.db or sqlite://file.sqlite, a path without scheme is a BoltDB file)")
 
 		// Application port
 		port = flag.String("port", "8090", "Server port")
 
 		// Application base path
 		baseUrl = flag.String("baseurl", "", "Base URL on the server (example : /api)")
+
+		// Automatic database snapshots
+		snapshotDir      = flag.String("snapshotdir", "", "Directory where database snapshots are saved (disabled if empty, BoltDB only)")
+		snapshotInterval = flag.Duration("snapshotinterval", 6*time.Hour, "Delay between two database snapshots")
+		snapshotDaily    = flag.Int("snapshotdaily", 7, "Number of days for which the latest snapshot is kept")
+		snapshotWeekly   = flag.Int("snapshotweekly", 4, "Number of weeks for which the latest snapshot is kept")
+
+		// Physical removal of deleted participants
+		retention     = flag.Duration("retention", services.DefaultRetention, "Delay before a deleted participant is physically removed")
+		purgeInterval = flag.Duration("purgeinterval", 24*time.Hour, "Delay between two purges of deleted participants")
+
+		// Removal of unconfirmed events
+		pendingExpiry = flag.Duration("pendingexpiry", services.DefaultPendingExpiry, "Delay for the confirmation of a new event")
+		sweepInterval = flag.Duration("sweepinterval", time.Hour, "Delay between two removals of expired unconfirmed events")
+
+		// Scheduled activity openings and closings
+		scheduleInterval = flag.Duration("scheduleinterval", time.Minute, "Delay between two checks of the scheduled activity openings and closings")
+
+		// Participants without their token
+		ipFallback = flag.Bool("ipfallback", false, "Let participants edit or cancel their participation from the IP used to sign up, without their token")
 	)
 
 	flag.Parse()
 
-	jeparticipe := app.NewApp(*dbFile)
+	// Offline restore of a backup : jeparticipe [-db bolt://file.db] restore <backup file>
+	if flag.Arg(0) == "restore" {
+		if flag.NArg() != 2 {
+			log.Fatal("Usage : jeparticipe [-db bolt://file.db] restore <backup file>")
+		}
+		if strings.HasPrefix(*dbUrl, "sqlite://") {
+			log.Fatal("Restore is only available with a BoltDB database")
+		}
+		if err := services.RestoreBackup(flag.Arg(1), strings.TrimPrefix(*dbUrl, "bolt://")); err != nil {
+			log.Fatal("Restore failed : " + err.Error())
+		}
+		fmt.Println("Backup restored, previous database (if any) saved with suffix " + services.BeforeRestoreSuffix)
+		return
+	}
+
+	// New superadmin password : jeparticipe [-db url] resetsuperadmin
+	if flag.Arg(0) == "resetsuperadmin" {
+		store := services.NewStore(*dbUrl)
+		store.CreateCollectionIfNotExists(services.PropertiesBucketName)
+		fmt.Println("Super admin password is " + services.ResetSuperAdminPassword(store))
+		store.ShutDown()
+		return
+	}
+
+	jeparticipe := app.NewApp(services.NewStore(*dbUrl))
 	defer jeparticipe.ShutDown()
+	jeparticipe.ActivityService.IPFallback = *ipFallback
+
+	if *snapshotDir != "" {
+		if err := jeparticipe.StartSnapshots(*snapshotDir, *snapshotInterval, *snapshotDaily, *snapshotWeekly); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := jeparticipe.StartRetention(*retention, *purgeInterval); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := jeparticipe.StartExpiry(*pendingExpiry, *sweepInterval); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := jeparticipe.StartSchedule(*scheduleInterval); err != nil {
+		log.Fatal(err)
+	}
 
-	fmt.Println("Super admin password is " + jeparticipe.SuperAdminPassword)
+	// Only the hash of the password is saved, so it is only shown when generated
+	if jeparticipe.SuperAdminPassword != "" {
+		fmt.Println("Super admin password is " + jeparticipe.SuperAdminPassword)
+	}
 
 	api := jeparticipe.BuildApi(app.ProdMode, *baseUrl)
 	log.Fatal(http.ListenAndServe(":"+*port, api.MakeHandler()))
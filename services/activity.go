@@ -4,17 +4,32 @@ import (
 	"errors"
 	"net/http"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/julienbayle/jeparticipe/email"
 	"github.com/julienbayle/jeparticipe/entities"
 )
 
 type ActivityService struct {
-	RepositoryService *RepositoryService
+	Store      Store
+	EmailRelay *email.EmailRelay
+	Secret     string
+
+	// Lets a participant edit or cancel its participation from the IP used to sign up, without its token
+	IPFallback bool
 }
 
 // GetActivity returns an activity by its code or inits a new activity without saving it to the database
 func (as *ActivityService) GetActivity(w rest.ResponseWriter, r *rest.Request) {
+	if !hasPermission(r, PermissionPublic) {
+		rest.Error(w, "Access forbidden", http.StatusForbidden)
+		return
+	}
+
 	activity, err := as.getOrCreateActivityFromRequest(r)
 
 	if err != nil {
@@ -22,35 +37,64 @@ func (as *ActivityService) GetActivity(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 
-	returnActivityAsJson(activity, w, r)
+	if activity.IsDraft() && !hasPermission(r, PermissionReadPrivateData) {
+		rest.Error(w, "Resource not found", http.StatusNotFound)
+		return
+	}
+
+	as.returnActivityAsJson(activity, w, r)
 }
 
-// AddAParticipantToAnActivity adds a participant to an activity
-func (as *ActivityService) AddAParticipantToAnActivity(w rest.ResponseWriter, r *rest.Request) {
-	activity, err := as.getOrCreateActivityFromRequest(r)
+// GetActivities returns all the saved activities of an event, sorted by display order
+func (as *ActivityService) GetActivities(w rest.ResponseWriter, r *rest.Request) {
+	if !hasPermission(r, PermissionPublic) {
+		rest.Error(w, "Access forbidden", http.StatusForbidden)
+		return
+	}
 
-	if err != nil {
+	if err := as.checkEventFromRequest(r); err != nil {
 		rest.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	if !activity.IsOpen() && !hasAdminPriviledge(r) {
+	activities, err := as.GetAllActivities(getEventCodeFromRequest(r))
+	if err != nil {
+		panic(err)
+	}
+
+	// Hides draft activities and private information if user is not allowed to read them
+	visibleActivities := make([]*activityResponse, 0, len(activities))
+	for _, activity := range activities {
+		if hasActivityPermission(r, PermissionReadPrivateData, activity.Code) {
+			visibleActivities = append(visibleActivities, newActivityResponse(activity))
+		} else if !activity.IsDraft() {
+			as.removePrivateData(activity, r)
+			visibleActivities = append(visibleActivities, newActivityResponse(activity))
+		}
+	}
+	w.WriteJson(visibleActivities)
+}
+
+// AddAParticipantToAnActivity adds a participant to an activity
+func (as *ActivityService) AddAParticipantToAnActivity(w rest.ResponseWriter, r *rest.Request) {
+	if !hasPermission(r, PermissionPublic) {
 		rest.Error(w, "Access forbidden", http.StatusForbidden)
 		return
 	}
 
-	if r.ContentLength > 512 {
-		rest.Error(w, "Participant data is limited to 512 characters.", http.StatusBadRequest)
+	if err := as.checkEventFromRequest(r); err != nil {
+		rest.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	if len(activity.Participants) > 100 {
-		rest.Error(w, "Number of participants has reach the limit", http.StatusBadRequest)
+	// The limit of the activity is checked with its form once loaded
+	if err := checkParticipantLength(r, nil); err != nil {
+		writeError(w, err)
 		return
 	}
 
 	participant := &entities.Participant{}
-	err = r.DecodeJsonPayload(&participant)
+	err := r.DecodeJsonPayload(&participant)
 	if err != nil {
 		rest.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -61,107 +105,539 @@ func (as *ActivityService) AddAParticipantToAnActivity(w rest.ResponseWriter, r
 		return
 	}
 
-	activity.AddParticipant(participant.PublicText, participant.PrivateText, getIp(r))
+	if participant.Count < 0 || participant.Count > entities.MaxHeadCount {
+		rest.Error(w, "Invalid participant count", http.StatusBadRequest)
+		return
+	}
+
+	emailValidator, _ := regexp.Compile(entities.EmailRegExp)
+	if participant.Email != "" && !emailValidator.MatchString(participant.Email) {
+		rest.Error(w, "Invalid email", http.StatusBadRequest)
+		return
+	}
+
+	var added *entities.Participant
+	activity, err := as.UpdateActivity(getActivityCodeFromRequest(r), getEventCodeFromRequest(r), func(activity *entities.Activity) error {
+		if !ifMatch(r, activity.Revision) {
+			return &requestError{"Activity has been modified", http.StatusPreconditionFailed}
+		}
+
+		if activity.IsArchived() {
+			return &requestError{"Activity is archived", http.StatusForbidden}
+		}
+
+		if err := checkParticipantLength(r, activity); err != nil {
+			return err
+		}
+
+		if !activity.IsOpen() && !activity.IsWaitlistOpen() && !hasPermission(r, PermissionManageParticipants) {
+			return &requestError{"Access forbidden", http.StatusForbidden}
+		}
+
+		if len(activity.Participants)+len(activity.Waitlist) > 100 {
+			return &requestError{"Number of participants has reach the limit", http.StatusBadRequest}
+		}
+
+		if err := entities.ValidateAnswers(activity.Form, participant.Answers); err != nil {
+			return &requestError{err.Error(), http.StatusBadRequest}
+		}
+
+		if !activity.HasRoomFor(participant.HeadCount()) {
+			if activity.IsFull() && !activity.WaitlistEnabled {
+				return &requestError{"Activity is full", http.StatusBadRequest}
+			}
+			if !activity.WaitlistEnabled || participant.HeadCount() > activity.Capacity {
+				return &requestError{"Not enough places left", http.StatusBadRequest}
+			}
+			added = activity.AddToWaitlist(participant.PublicText, participant.PrivateText, getIp(r))
+		} else {
+			added = activity.AddParticipant(participant.PublicText, participant.PrivateText, getIp(r))
+		}
+		added.Email = participant.Email
+		added.Count = participant.Count
+		added.Answers = participant.Answers
+		activity.UpdateStateFromCapacity()
+		return nil
+	})
 
-	err = as.SaveActivity(activity, getEventCodeFromRequest(r))
 	if err != nil {
-		panic(err)
+		writeError(w, err)
+		return
 	}
 
-	returnActivityAsJson(activity, w, r)
+	// The token is only given back to the participant, it is not saved
+	added.Token = added.CancelToken(getEventCodeFromRequest(r), as.Secret)
+	as.returnActivityAsJson(activity, w, r, added.Token)
 }
 
-// RemoveAParticipantFromAnActivity removes a participant from an activity
+// RemoveAParticipantFromAnActivity removes a participant from an activity (participant owner or participant managers)
 func (as *ActivityService) RemoveAParticipantFromAnActivity(w rest.ResponseWriter, r *rest.Request) {
-	activity, err := as.getOrCreateActivityFromRequest(r)
+	if err := as.checkEventFromRequest(r); err != nil {
+		rest.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var promoted []*entities.Participant
+	activity, err := as.UpdateActivity(getActivityCodeFromRequest(r), getEventCodeFromRequest(r), func(activity *entities.Activity) error {
+		if !ifMatch(r, activity.Revision) {
+			return &requestError{"Activity has been modified", http.StatusPreconditionFailed}
+		}
+
+		if activity.IsArchived() {
+			return &requestError{"Activity is archived", http.StatusForbidden}
+		}
+
+		participant, waitlisted := findParticipantFromRequest(r, activity)
+
+		if participant == nil {
+			return &requestError{"Resource not found", http.StatusNotFound}
+		}
+
+		if !as.isOwnerWhileOpen(r, activity, participant, waitlisted) && !hasPermission(r, PermissionManageParticipants) {
+			return &requestError{"Forbidden", http.StatusForbidden}
+		}
+
+		if waitlisted {
+			activity.RemoveFromWaitlist(participant.Code)
+		} else {
+			activity.RemoveParticipant(participant.Code)
+		}
+		promoted = activity.PromoteFromWaitlist()
+		activity.UpdateStateFromCapacity()
+		return nil
+	})
 
 	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	as.notifyPromotedParticipants(r, activity, promoted)
+
+	as.returnActivityAsJson(activity, w, r)
+}
+
+// UpdateAParticipantOfAnActivity updates the texts and the answers of a participant (participant owner or participant managers)
+// Answers are left unchanged if they are not sent
+func (as *ActivityService) UpdateAParticipantOfAnActivity(w rest.ResponseWriter, r *rest.Request) {
+	if err := as.checkEventFromRequest(r); err != nil {
 		rest.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	participant := activity.GetParticipant(getParticipantCodeFromRequest(r))
+	// The limit of the activity is checked with its form once loaded
+	if err := checkParticipantLength(r, nil); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	update := &entities.Participant{}
+	if err := r.DecodeJsonPayload(update); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if update.PublicText == "" {
+		rest.Error(w, "Some public text required", http.StatusBadRequest)
+		return
+	}
+
+	activity, err := as.UpdateActivity(getActivityCodeFromRequest(r), getEventCodeFromRequest(r), func(activity *entities.Activity) error {
+		if !ifMatch(r, activity.Revision) {
+			return &requestError{"Activity has been modified", http.StatusPreconditionFailed}
+		}
+
+		if activity.IsArchived() {
+			return &requestError{"Activity is archived", http.StatusForbidden}
+		}
+
+		participant, waitlisted := findParticipantFromRequest(r, activity)
+
+		if participant == nil || !participant.DeletedAt.After(time.Now()) {
+			return &requestError{"Resource not found", http.StatusNotFound}
+		}
+
+		if !as.isOwnerWhileOpen(r, activity, participant, waitlisted) && !hasPermission(r, PermissionManageParticipants) {
+			return &requestError{"Forbidden", http.StatusForbidden}
+		}
+
+		if err := checkParticipantLength(r, activity); err != nil {
+			return err
+		}
+
+		if update.Answers != nil {
+			if err := entities.ValidateAnswers(activity.Form, update.Answers); err != nil {
+				return &requestError{err.Error(), http.StatusBadRequest}
+			}
+			participant.Answers = update.Answers
+		}
+
+		activity.UpdateParticipant(participant.Code, update.PublicText, update.PrivateText)
+		return nil
+	})
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	as.returnActivityAsJson(activity, w, r)
+}
 
-	if participant == nil {
-		rest.NotFound(w, r)
+// MoveAParticipant moves a participant to another activity of the event
+func (as *ActivityService) MoveAParticipant(w rest.ResponseWriter, r *rest.Request) {
+	if err := as.checkEventFromRequest(r); err != nil {
+		rest.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	if (getIp(r) != participant.CreatedBy || !activity.IsOpen()) && !hasAdminPriviledge(r) {
+	if !hasPermission(r, PermissionEditActivities) {
 		rest.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
-	activity.RemoveParticipant(participant.Code)
-	err = as.SaveActivity(activity, getEventCodeFromRequest(r))
+	sourceCode := getActivityCodeFromRequest(r)
+	targetCode := getTargetActivityCodeFromRequest(r)
+	if targetCode == "" || targetCode == sourceCode {
+		rest.Error(w, "Invalid target activity", http.StatusBadRequest)
+		return
+	}
+
+	var promoted []*entities.Participant
+	activities, err := as.UpdateActivityGroup([]string{sourceCode, targetCode}, getEventCodeFromRequest(r), func(activities []*entities.Activity) error {
+		// Like any activity, the target is created by its first participant
+		source, target := activities[0], activities[1]
+
+		if source.IsArchived() || target.IsArchived() {
+			return &requestError{"Activity is archived", http.StatusForbidden}
+		}
+
+		if target.IsDraft() {
+			return &requestError{"Target activity is a draft", http.StatusForbidden}
+		}
+
+		participant, _ := findParticipantFromRequest(r, source)
+		if participant == nil || !participant.DeletedAt.After(time.Now()) {
+			return &requestError{"Resource not found", http.StatusNotFound}
+		}
+
+		if err := entities.ValidateMovedAnswers(source.Form, target.Form, participant.Answers); err != nil {
+			return &requestError{err.Error(), http.StatusBadRequest}
+		}
+
+		if len(target.Participants)+len(target.Waitlist) > 100 {
+			return &requestError{"Number of participants has reach the limit", http.StatusBadRequest}
+		}
+
+		if !target.HasRoomFor(participant.HeadCount()) {
+			return &requestError{"Not enough places left", http.StatusBadRequest}
+		}
+
+		source.MoveParticipant(participant.Code, target, r.Env["REMOTE_USER"].(string))
+		promoted = source.PromoteFromWaitlist()
+		source.UpdateStateFromCapacity()
+		target.UpdateStateFromCapacity()
+		return nil
+	})
+
 	if err != nil {
-		panic(err)
+		writeError(w, err)
+		return
 	}
 
-	returnActivityAsJson(activity, w, r)
+	as.notifyPromotedParticipants(r, activities[0], promoted)
+	w.WriteJson(map[string]*activityResponse{"from": newActivityResponse(activities[0]), "to": newActivityResponse(activities[1])})
+}
+
+// UpdateActivityDetails replaces the details of an activity (title, description, schedule, location, order, capacity, form...)
+// The details which are not sent are cleared
+func (as *ActivityService) UpdateActivityDetails(w rest.ResponseWriter, r *rest.Request) {
+	if err := as.checkEventFromRequest(r); err != nil {
+		rest.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if !hasPermission(r, PermissionEditActivities) {
+		rest.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if r.ContentLength > 10000 {
+		rest.Error(w, "Activity data is limited to 10000 characters.", http.StatusBadRequest)
+		return
+	}
+
+	details := &entities.ActivityDetails{}
+	if err := r.DecodeJsonPayload(details); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := details.Validate(); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var promoted []*entities.Participant
+	activity, err := as.UpdateActivity(getActivityCodeFromRequest(r), getEventCodeFromRequest(r), func(activity *entities.Activity) error {
+		if !ifMatch(r, activity.Revision) {
+			return &requestError{"Activity has been modified", http.StatusPreconditionFailed}
+		}
+
+		if activity.IsArchived() {
+			return &requestError{"Activity is archived", http.StatusForbidden}
+		}
+
+		if err := activity.ValidateFormChange(details.Form); err != nil {
+			return &requestError{err.Error(), http.StatusBadRequest}
+		}
+
+		activity.ActivityDetails = *details
+		promoted = activity.PromoteFromWaitlist()
+		activity.UpdateStateFromCapacity()
+		return nil
+	})
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	as.notifyPromotedParticipants(r, activity, promoted)
+
+	as.returnActivityAsJson(activity, w, r)
 }
 
 // UpdateActivityState updates activity state
 func (as *ActivityService) UpdateActivityState(w rest.ResponseWriter, r *rest.Request) {
-	activity, err := as.getOrCreateActivityFromRequest(r)
+	if err := as.checkEventFromRequest(r); err != nil {
+		rest.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	activity, err := as.UpdateActivity(getActivityCodeFromRequest(r), getEventCodeFromRequest(r), func(activity *entities.Activity) error {
+		if !ifMatch(r, activity.Revision) {
+			return &requestError{"Activity has been modified", http.StatusPreconditionFailed}
+		}
+
+		if err := checkStateChange(r); err != nil {
+			return err
+		}
+
+		// A state set by the event admin is never changed automatically
+		activity.State = r.PathParam("state")
+		activity.AutoClosed = false
+		return nil
+	})
 
 	if err != nil {
-		rest.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, err)
 		return
 	}
 
-	activity.State = r.PathParam("state")
+	as.returnActivityAsJson(activity, w, r)
+}
 
-	if !activity.IsStateValid() {
-		rest.Error(w, "Invalid state", http.StatusBadRequest)
+// UpdateActivitiesState updates the state of all the activities of an event in a single transaction
+// Query parameters "tag" and "prefix" (activity code prefix) select a subset, archived activities are left unchanged
+// Returns the updated activities
+func (as *ActivityService) UpdateActivitiesState(w rest.ResponseWriter, r *rest.Request) {
+	if err := as.checkEventFromRequest(r); err != nil {
+		rest.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	if !hasAdminPriviledge(r) {
-		rest.Error(w, "Forbidden", http.StatusForbidden)
+	if err := checkStateChange(r); err != nil {
+		writeError(w, err)
 		return
 	}
 
-	err = as.SaveActivity(activity, getEventCodeFromRequest(r))
+	state := r.PathParam("state")
+	tag := r.URL.Query().Get("tag")
+	prefix := r.URL.Query().Get("prefix")
+
+	activities, err := as.UpdateActivities(getEventCodeFromRequest(r), func(activity *entities.Activity) (bool, error) {
+		if activity.IsArchived() || activity.State == state || !strings.HasPrefix(activity.Code, prefix) {
+			return false, nil
+		}
+		if tag != "" && !activity.HasTag(tag) {
+			return false, nil
+		}
+
+		// A state set by the event admin is never changed automatically
+		activity.State = state
+		activity.AutoClosed = false
+		return true, nil
+	})
+
 	if err != nil {
-		panic(err)
+		writeError(w, err)
+		return
 	}
 
-	returnActivityAsJson(activity, w, r)
+	responses := make([]*activityResponse, len(activities))
+	for i, activity := range activities {
+		responses[i] = newActivityResponse(activity)
+	}
+	w.WriteJson(responses)
 }
 
-// GetOrCreateActivity gets an activity from bolt database or creates a new one (without saving it to the database)
+// GetOrCreateActivity gets an activity from the store or creates a new one (without saving it to the database)
 func (as *ActivityService) GetOrCreateActivity(activityCode string, eventCode string) *entities.Activity {
 	activity := entities.NewActivity(activityCode)
-	as.RepositoryService.GetDocument(GetActivityBucketName(eventCode), activity.Code, activity)
+	as.Store.GetDocument(GetActivityBucketName(eventCode), activity.Code, activity)
 	return activity
 }
 
-// SaveActivity saves an activity to the bolt database
+// GetAllActivities returns all the saved activities of an event, sorted by display order then by code
+func (as *ActivityService) GetAllActivities(eventCode string) ([]*entities.Activity, error) {
+	codes, err := as.Store.GetIdentifiers(GetActivityBucketName(eventCode))
+	if err != nil {
+		return nil, err
+	}
+
+	activities := make([]*entities.Activity, 0, len(codes))
+	for _, code := range codes {
+		activity := entities.NewActivity(code)
+		if err := as.Store.GetDocument(GetActivityBucketName(eventCode), code, activity); err != nil {
+			return nil, err
+		}
+		activities = append(activities, activity)
+	}
+
+	sort.Stable(byOrder(activities))
+	return activities, nil
+}
+
+// SaveActivity saves an activity to the store
 func (as *ActivityService) SaveActivity(activity *entities.Activity, eventCode string) error {
 	if !activity.IsStateValid() {
 		return errors.New("Activity can't be saved, invalid state")
 	}
-	return as.RepositoryService.CommitDocument(GetActivityBucketName(eventCode), activity.Code, activity)
+	activity.Revision++
+	return as.Store.CommitDocument(GetActivityBucketName(eventCode), activity.Code, activity)
+}
+
+// UpdateActivity loads (or inits) an activity, applies update and saves it atomically
+// Nothing is saved if update returns an error
+func (as *ActivityService) UpdateActivity(activityCode string, eventCode string, update func(activity *entities.Activity) error) (*entities.Activity, error) {
+	activity := entities.NewActivity(activityCode)
+	err := as.Store.UpdateDocument(GetActivityBucketName(eventCode), activity.Code, activity, func() error {
+		if err := update(activity); err != nil {
+			return err
+		}
+		if !activity.IsStateValid() {
+			return errors.New("Activity can't be saved, invalid state")
+		}
+		activity.Revision++
+		return nil
+	})
+	return activity, err
+}
+
+// notifyPromotedParticipants sends an email to the participants who left the waiting list (if they gave an email)
+func (as *ActivityService) notifyPromotedParticipants(r *rest.Request, activity *entities.Activity, promoted []*entities.Participant) {
+	activityName := activity.Title
+	if activityName == "" {
+		activityName = activity.Code
+	}
+
+	for _, participant := range promoted {
+		if participant.Email == "" {
+			continue
+		}
+
+		templateData := struct {
+			URL      string
+			Name     string
+			Activity string
+		}{
+			URL:      r.BaseUrl().String() + "/" + getEventCodeFromRequest(r),
+			Name:     participant.PublicText,
+			Activity: activityName,
+		}
+		email := email.NewEmail(participant.Email, "Circuleo - Je participe ! - Votre participation est confirmée", "")
+		email.AddBodyUsingTemplate("../templates/promoted.html", templateData)
+		as.EmailRelay.Send(email)
+	}
+}
+
+// UpdateActivityGroup loads (or inits) several activities of an event, applies update and saves them in a single transaction
+// Nothing is saved if update returns an error
+func (as *ActivityService) UpdateActivityGroup(activityCodes []string, eventCode string, update func(activities []*entities.Activity) error) ([]*entities.Activity, error) {
+	activities := make([]*entities.Activity, len(activityCodes))
+	documents := make([]interface{}, len(activityCodes))
+	for i, activityCode := range activityCodes {
+		activities[i] = entities.NewActivity(activityCode)
+		documents[i] = activities[i]
+	}
+
+	err := as.Store.UpdateDocumentGroup(GetActivityBucketName(eventCode), activityCodes, documents, func() error {
+		if err := update(activities); err != nil {
+			return err
+		}
+		for _, activity := range activities {
+			if !activity.IsStateValid() {
+				return errors.New("Activity can't be saved, invalid state")
+			}
+			activity.Revision++
+		}
+		return nil
+	})
+	return activities, err
+}
+
+// UpdateActivities applies update to all the activities of an event and saves the changed ones in a single transaction
+// update returns false to leave an activity unchanged, nothing is saved if update returns an error
+// Returns the changed activities, sorted by display order
+func (as *ActivityService) UpdateActivities(eventCode string, update func(activity *entities.Activity) (bool, error)) ([]*entities.Activity, error) {
+	changed := make([]*entities.Activity, 0)
+	err := as.Store.UpdateDocuments(GetActivityBucketName(eventCode), func(activityCode string) interface{} {
+		return entities.NewActivity(activityCode)
+	}, func(activityCode string, document interface{}) (bool, error) {
+		activity := document.(*entities.Activity)
+		ok, err := update(activity)
+		if err != nil || !ok {
+			return false, err
+		}
+		if !activity.IsStateValid() {
+			return false, errors.New("Activity can't be saved, invalid state")
+		}
+		activity.Revision++
+		changed = append(changed, activity)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Stable(byOrder(changed))
+	return changed, nil
 }
 
 // getOrCreateActivityFromRequest is a convenient method to get current activity using request parameters as criteria
 func (as *ActivityService) getOrCreateActivityFromRequest(r *rest.Request) (*entities.Activity, error) {
-	activityCode := getActivityCodeFromRequest(r)
-	eventCode := getEventCodeFromRequest(r)
+	if err := as.checkEventFromRequest(r); err != nil {
+		return nil, err
+	}
+
+	return as.GetOrCreateActivity(getActivityCodeFromRequest(r), getEventCodeFromRequest(r)), nil
+}
 
+// checkEventFromRequest returns an error if the request event does not exist or is not confirmed
+func (as *ActivityService) checkEventFromRequest(r *rest.Request) error {
 	event := &entities.Event{}
-	as.RepositoryService.GetDocument(EventsBucketName, eventCode, event)
+	as.Store.GetDocument(EventsBucketName, getEventCodeFromRequest(r), event)
 
 	if event.Code == "" {
-		return nil, errors.New("Invalid event code")
+		return errors.New("Invalid event code")
 	}
 
 	if !event.EmailConfirmed {
-		return nil, errors.New("Event not confirmed yet")
+		return errors.New("Event not confirmed yet")
 	}
 
-	return as.GetOrCreateActivity(activityCode, eventCode), nil
+	return nil
 }
 
 // GetActivityBucketName is a convenient method to generate the collection name where to save activities for a specific event
@@ -170,13 +646,113 @@ func GetActivityBucketName(eventCode string) string {
 }
 
 // returnActivityAsJson is a convenient method to not forget to remove private data if needed when sendint back activiy
-func returnActivityAsJson(activity *entities.Activity, w rest.ResponseWriter, r *rest.Request) {
+func (as *ActivityService) returnActivityAsJson(activity *entities.Activity, w rest.ResponseWriter, r *rest.Request, tokens ...string) {
+	// Hides private information if user is not allowed to read them
+	if !hasActivityPermission(r, PermissionReadPrivateData, activity.Code) {
+		as.removePrivateData(activity, r, tokens...)
+	}
+	w.Header().Set("ETag", etag(activity.Revision))
+	w.WriteJson(newActivityResponse(activity))
+}
+
+// activityResponse is an activity sent back to the client, with the number of people signed up (never saved)
+type activityResponse struct {
+	*entities.Activity
+	Headcount int
+}
+
+// newActivityResponse counts the people signed up to an activity before sending it back
+func newActivityResponse(activity *entities.Activity) *activityResponse {
+	return &activityResponse{Activity: activity, Headcount: activity.CountParticipants()}
+}
+
+// byOrder sorts activities by display order
+type byOrder []*entities.Activity
+
+func (a byOrder) Len() int           { return len(a) }
+func (a byOrder) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byOrder) Less(i, j int) bool { return a[i].Order < a[j].Order }
+
+// findParticipantFromRequest returns the participant (or the waitlisted participant) matching the request participant code
+func findParticipantFromRequest(r *rest.Request, activity *entities.Activity) (*entities.Participant, bool) {
+	participantCode := getParticipantCodeFromRequest(r)
+	if participant := activity.GetParticipant(participantCode); participant != nil {
+		return participant, false
+	}
+	participant := activity.GetWaitlisted(participantCode)
+	return participant, participant != nil
+}
+
+// removePrivateData hides private information of the participants not owned by the user
+func (as *ActivityService) removePrivateData(activity *entities.Activity, r *rest.Request, tokens ...string) {
+	tokens = append(tokens, getParticipantTokensFromRequest(r)...)
+	activity.RemovePrivateDataExcept(func(participant *entities.Participant) bool {
+		return as.isParticipantOwner(r, participant, tokens)
+	})
+}
+
+// isParticipantOwner returns true if one of the tokens is the participant token
+// or, if the IP fallback is enabled, if the request comes from the IP used to sign up
+func (as *ActivityService) isParticipantOwner(r *rest.Request, participant *entities.Participant, tokens []string) bool {
+	eventCode := getEventCodeFromRequest(r)
+	for _, token := range tokens {
+		if participant.IsTokenValid(token, eventCode, as.Secret) {
+			return true
+		}
+	}
+	return as.IPFallback && getIp(r) == participant.CreatedBy
+}
+
+// isOwnerWhileOpen returns true if the user is the participant owner while the activity is open
+// A full activity still accepts changes and cancellations, and one can always leave the waiting list
+func (as *ActivityService) isOwnerWhileOpen(r *rest.Request, activity *entities.Activity, participant *entities.Participant, waitlisted bool) bool {
+	open := activity.IsOpen() || activity.AutoClosed || waitlisted
+	return as.isParticipantOwner(r, participant, getParticipantTokensFromRequest(r)) && open
+}
 
-	// Hides private information if user does not have admin priviledges
-	if !hasAdminPriviledge(r) {
-		activity.RemovePrivateData(getIp(r))
+// checkParticipantLength returns an error if the participant data is too long for the activity
+// Answers to a form need more room, without activity the largest limit is checked
+func checkParticipantLength(r *rest.Request, activity *entities.Activity) error {
+	maxLength := int64(8192)
+	if activity != nil && len(activity.Form) == 0 {
+		maxLength = 512
 	}
-	w.WriteJson(activity)
+
+	if r.ContentLength > maxLength {
+		return &requestError{"Participant data is limited to " + strconv.FormatInt(maxLength, 10) + " characters.", http.StatusBadRequest}
+	}
+	return nil
+}
+
+// checkStateChange returns an error if the requested state is invalid or if the user is not allowed to edit activities
+func checkStateChange(r *rest.Request) error {
+	if !entities.IsValidState(r.PathParam("state")) {
+		return &requestError{"Invalid state", http.StatusBadRequest}
+	}
+
+	if !hasPermission(r, PermissionEditActivities) {
+		return &requestError{"Forbidden", http.StatusForbidden}
+	}
+	return nil
+}
+
+// requestError is an error sent back to the client with a specific HTTP status code
+type requestError struct {
+	Message string
+	Status  int
+}
+
+func (e *requestError) Error() string {
+	return e.Message
+}
+
+// writeError sends a requestError back to the client, other errors are unexpected
+func writeError(w rest.ResponseWriter, err error) {
+	if re, ok := err.(*requestError); ok {
+		rest.Error(w, re.Message, re.Status)
+		return
+	}
+	panic(err)
 }
 
 // getActivityCodeFromRequest is a convenient method to get activity code from request
@@ -185,6 +761,21 @@ func getActivityCodeFromRequest(r *rest.Request) string {
 	return extractor.FindString(r.PathParam("acode"))
 }
 
+// getTargetActivityCodeFromRequest is a convenient method to get the target activity code of a move from request
+func getTargetActivityCodeFromRequest(r *rest.Request) string {
+	extractor, _ := regexp.Compile("[-A-Za-z0-9]{2,50}")
+	return extractor.FindString(r.PathParam("target"))
+}
+
+// getParticipantTokensFromRequest returns the participant token sent in the X-Participant-Token header
+// The token is never read from the URL, which is written to the access logs
+func getParticipantTokensFromRequest(r *rest.Request) []string {
+	if token := r.Header.Get("X-Participant-Token"); token != "" {
+		return []string{token}
+	}
+	return nil
+}
+
 // getParticipantCodeFromRequest is a convenient method to get participant code from request
 func getParticipantCodeFromRequest(r *rest.Request) string {
 	extractor, _ := regexp.Compile("[a-f0-9]{64}")
@@ -3,10 +3,17 @@ package services_test
 import (
 	"github.com/ant0ine/go-json-rest/rest/test"
 	"github.com/julienbayle/jeparticipe/app/test"
+	"github.com/julienbayle/jeparticipe/email"
 	"github.com/julienbayle/jeparticipe/entities"
+	"github.com/julienbayle/jeparticipe/services"
 	"github.com/stretchr/testify/assert"
 
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestGetAndAddParticipantActivityService(t *testing.T) {
@@ -14,6 +21,9 @@ func TestGetAndAddParticipantActivityService(t *testing.T) {
 	jeparticipe, handler, event := apptest.CreateATestApp()
 	defer apptest.DeleteTestApp(jeparticipe)
 
+	// Participants are recognized by their sign-up IP
+	jeparticipe.ActivityService.IPFallback = true
+
 	// ------------------------------------
 	// Get a new activity (Event does not exist)
 	// ------------------------------------
@@ -193,6 +203,9 @@ func TestRemoveParticipantActivityService(t *testing.T) {
 	jeparticipe, handler, event := apptest.CreateATestApp()
 	defer apptest.DeleteTestApp(jeparticipe)
 
+	// Participants are recognized by their sign-up IP
+	jeparticipe.ActivityService.IPFallback = true
+
 	// ------------------------------------
 	// Remove a participant that does not exist
 	// ------------------------------------
@@ -390,3 +403,1028 @@ func TestChangeStateActivityService(t *testing.T) {
 	activity := jeparticipe.ActivityService.GetOrCreateActivity("testbucket", "testevent")
 	assert.Equal(t, entities.StateClosed, activity.State)
 }
+
+func TestUpdateActivityDetailsActivityService(t *testing.T) {
+
+	jeparticipe, handler, event := apptest.CreateATestApp()
+	defer apptest.DeleteTestApp(jeparticipe)
+
+	details := map[string]interface{}{
+		"Title":       "Bar",
+		"Description": "Serve drinks",
+		"StartAt":     "2017-06-24T14:00:00+02:00",
+		"EndAt":       "2017-06-24T16:00:00+02:00",
+		"Location":    "Playground",
+		"Order":       2,
+	}
+
+	// ------------------------------------
+	// Event does not exist
+	// ------------------------------------
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("PUT", "/event/donotexists/activity/bar", details))
+	recorded.CodeIs(404)
+
+	// ------------------------------------
+	// Without permission
+	// ------------------------------------
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("PUT", "/event/testevent/activity/bar", details))
+	recorded.CodeIs(403)
+
+	// ------------------------------------
+	// Invalid details
+	// ------------------------------------
+
+	token := apptest.GetAdminTokenForEvent(t, &handler, event)
+	invalid := map[string]interface{}{"StartAt": "2017-06-24T14:00:00Z", "EndAt": "2017-06-24T12:00:00Z"}
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/bar", invalid, token))
+	recorded.CodeIs(400)
+	recorded.BodyIs("{\"Error\":\"End time is before start time\"}")
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/bar", map[string]interface{}{"StartAt": "tomorrow"}, token))
+	recorded.CodeIs(400)
+
+	// ------------------------------------
+	// Update as event admin, participants and state are kept
+	// ------------------------------------
+
+	activity := jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code)
+	activity.State = entities.StateClosed
+	activity.AddParticipant("public", "private", "ip")
+	assert.NoError(t, jeparticipe.ActivityService.SaveActivity(activity, event.Code))
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/bar", details, token))
+	recorded.CodeIs(200)
+
+	activity = jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code)
+	assert.Equal(t, "Bar", activity.Title)
+	assert.Equal(t, "Serve drinks", activity.Description)
+	assert.Equal(t, "Playground", activity.Location)
+	assert.Equal(t, 2, activity.Order)
+	assert.Equal(t, 2*time.Hour, activity.EndAt.Sub(activity.StartAt))
+	assert.Equal(t, entities.StateClosed, activity.State)
+	assert.Len(t, activity.Participants, 1)
+
+	// ------------------------------------
+	// Details are public
+	// ------------------------------------
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "/event/testevent/activity/bar", nil))
+	recorded.CodeIs(200)
+	activity = &entities.Activity{}
+	assert.NoError(t, recorded.DecodeJsonPayload(activity))
+	assert.Equal(t, "Bar", activity.Title)
+	assert.Equal(t, "Playground", activity.Location)
+
+	// ------------------------------------
+	// Stale revision
+	// ------------------------------------
+
+	rq := apptest.MakeAdminRequest("PUT", "/event/testevent/activity/bar", details, token)
+	rq.Header.Set("If-Match", `"1"`)
+	recorded = test.RunRequest(t, handler, rq)
+	recorded.CodeIs(412)
+}
+
+func TestCapacityActivityService(t *testing.T) {
+
+	jeparticipe, handler, event := apptest.CreateATestApp()
+	defer apptest.DeleteTestApp(jeparticipe)
+
+	token := apptest.GetAdminTokenForEvent(t, &handler, event)
+	details := map[string]interface{}{"Title": "Bar", "Capacity": 2, "ReopenWhenAvailable": true}
+	recorded := test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/bar", details, token))
+	recorded.CodeIs(200)
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/bar", map[string]interface{}{"Capacity": -1}, token))
+	recorded.CodeIs(400)
+
+	// ------------------------------------
+	// Activity is closed when full
+	// ------------------------------------
+
+	participant := map[string]string{"text": "public", "admintext": "private"}
+	rq := test.MakeSimpleRequest("PUT", "/event/testevent/activity/bar/participant", participant)
+	rq.Header.Set("X-Real-IP", "111.111.111.111")
+	recorded = test.RunRequest(t, handler, rq)
+	recorded.CodeIs(200)
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("PUT", "/event/testevent/activity/bar/participant", participant))
+	recorded.CodeIs(200)
+
+	activity := jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code)
+	assert.Equal(t, entities.StateClosed, activity.State)
+
+	// Even the event admin can not add a participant to a full activity
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/bar/participant", participant, token))
+	recorded.CodeIs(400)
+	recorded.BodyIs("{\"Error\":\"Activity is full\"}")
+
+	// ------------------------------------
+	// Activity is reopened when a participant cancels
+	// ------------------------------------
+
+	rq = apptest.MakeAdminRequest("GET", "/event/testevent/activity/bar/participant/"+activity.Participants[0].Code+"/delete", nil, token)
+	recorded = test.RunRequest(t, handler, rq)
+	recorded.CodeIs(200)
+
+	activity = jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code)
+	assert.Equal(t, entities.StateOpen, activity.State)
+	assert.Equal(t, 1, activity.CountParticipants())
+
+	// ------------------------------------
+	// Lowering the capacity closes the activity
+	// ------------------------------------
+
+	details["Capacity"] = 1
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/bar", details, token))
+	recorded.CodeIs(200)
+	activity = jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code)
+	assert.Equal(t, entities.StateClosed, activity.State)
+	assert.True(t, activity.AutoClosed)
+}
+
+func TestWaitlistActivityService(t *testing.T) {
+
+	jeparticipe, handler, event := apptest.CreateATestApp()
+	defer apptest.DeleteTestApp(jeparticipe)
+
+	// Participants are recognized by their sign-up IP
+	jeparticipe.ActivityService.IPFallback = true
+
+	sentEmails := make([]*email.Email, 0)
+	jeparticipe.ActivityService.EmailRelay = &email.EmailRelay{
+		Send: func(email *email.Email) error {
+			sentEmails = append(sentEmails, email)
+			return nil
+		},
+	}
+
+	token := apptest.GetAdminTokenForEvent(t, &handler, event)
+	details := map[string]interface{}{"Title": "Bar", "Capacity": 1, "WaitlistEnabled": true}
+	recorded := test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/bar", details, token))
+	recorded.CodeIs(200)
+
+	addParticipant := func(text string, email string, ip string) *httptest.ResponseRecorder {
+		participant := map[string]string{"text": text, "admintext": "private", "email": email}
+		rq := test.MakeSimpleRequest("PUT", "/event/testevent/activity/bar/participant", participant)
+		rq.Header.Set("X-Real-IP", ip)
+		return test.RunRequest(t, handler, rq).Recorder
+	}
+
+	// ------------------------------------
+	// Sign-ups beyond capacity go to the waiting list
+	// ------------------------------------
+
+	assert.Equal(t, 200, addParticipant("first", "", "111.111.111.111").Code)
+	assert.Equal(t, 400, addParticipant("second", "invalid", "222.222.222.222").Code)
+	assert.Equal(t, 200, addParticipant("second", "second@test.com", "222.222.222.222").Code)
+	assert.Equal(t, 200, addParticipant("third", "third@test.com", "333.333.333.333").Code)
+
+	activity := jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code)
+	assert.Equal(t, entities.StateClosed, activity.State)
+	assert.Len(t, activity.Participants, 1)
+	assert.Len(t, activity.Waitlist, 2)
+	assert.Equal(t, "second@test.com", activity.Waitlist[0].Email)
+
+	// Private data of waitlisted participants is hidden
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "/event/testevent/activity/bar", nil))
+	publicActivity := &entities.Activity{}
+	assert.NoError(t, recorded.DecodeJsonPayload(publicActivity))
+	assert.Len(t, publicActivity.Waitlist, 2)
+	assert.Equal(t, "second", publicActivity.Waitlist[0].PublicText)
+	assert.Equal(t, "", publicActivity.Waitlist[0].Email)
+	assert.Equal(t, "", publicActivity.Waitlist[0].PrivateText)
+
+	// ------------------------------------
+	// A waitlisted participant leaves the waiting list
+	// ------------------------------------
+
+	rq := test.MakeSimpleRequest("GET", "/event/testevent/activity/bar/participant/"+activity.Waitlist[1].Code+"/delete", nil)
+	rq.Header.Set("X-Real-IP", "333.333.333.333")
+	recorded = test.RunRequest(t, handler, rq)
+	recorded.CodeIs(200)
+	assert.Len(t, jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code).Waitlist, 1)
+	assert.Len(t, sentEmails, 0)
+
+	// ------------------------------------
+	// A participant cancels (activity is full but cancellation is allowed), first waitlisted is promoted
+	// ------------------------------------
+
+	rq = test.MakeSimpleRequest("GET", "/event/testevent/activity/bar/participant/"+activity.Participants[0].Code+"/delete", nil)
+	rq.Header.Set("X-Real-IP", "111.111.111.111")
+	recorded = test.RunRequest(t, handler, rq)
+	recorded.CodeIs(200)
+
+	activity = jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code)
+	assert.Len(t, activity.Waitlist, 0)
+	assert.Equal(t, 1, activity.CountParticipants())
+	assert.Equal(t, "second", activity.Participants[1].PublicText)
+	assert.Equal(t, entities.StateClosed, activity.State)
+
+	assert.Len(t, sentEmails, 1)
+	assert.Equal(t, "second@test.com", sentEmails[0].To)
+	assert.Contains(t, sentEmails[0].Body, "Bar")
+
+	// ------------------------------------
+	// Raising the capacity promotes waitlisted participants
+	// ------------------------------------
+
+	assert.Equal(t, 200, addParticipant("fourth", "fourth@test.com", "444.444.444.444").Code)
+	details["Capacity"] = 2
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/bar", details, token))
+	recorded.CodeIs(200)
+
+	activity = jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code)
+	assert.Len(t, activity.Waitlist, 0)
+	assert.Equal(t, 2, activity.CountParticipants())
+	assert.Len(t, sentEmails, 2)
+	assert.Equal(t, "fourth@test.com", sentEmails[1].To)
+}
+
+func TestGroupSignUpActivityService(t *testing.T) {
+
+	jeparticipe, handler, event := apptest.CreateATestApp()
+	defer apptest.DeleteTestApp(jeparticipe)
+
+	token := apptest.GetAdminTokenForEvent(t, &handler, event)
+	details := map[string]interface{}{"Title": "Cakes", "Capacity": 5}
+	recorded := test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/cakes", details, token))
+	recorded.CodeIs(200)
+
+	addGroup := func(count int) *httptest.ResponseRecorder {
+		participant := map[string]interface{}{"text": "family", "count": count}
+		return test.RunRequest(t, handler, test.MakeSimpleRequest("PUT", "/event/testevent/activity/cakes/participant", participant)).Recorder
+	}
+
+	assert.Equal(t, 400, addGroup(-1).Code)
+	assert.Equal(t, 400, addGroup(entities.MaxHeadCount+1).Code)
+	assert.Equal(t, 200, addGroup(3).Code)
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("PUT", "/event/testevent/activity/cakes/participant", map[string]interface{}{"text": "family", "count": 3}))
+	recorded.CodeIs(400)
+	recorded.BodyIs("{\"Error\":\"Not enough places left\"}")
+
+	assert.Equal(t, 200, addGroup(2).Code)
+
+	activity := jeparticipe.ActivityService.GetOrCreateActivity("cakes", event.Code)
+	assert.Len(t, activity.Participants, 2)
+	assert.Equal(t, 5, activity.CountParticipants())
+	assert.Equal(t, entities.StateClosed, activity.State)
+
+	// The head count is sent back with the activity
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "/event/testevent/activity/cakes", nil))
+	recorded.CodeIs(200)
+	result := map[string]interface{}{}
+	assert.NoError(t, recorded.DecodeJsonPayload(&result))
+	assert.Equal(t, float64(5), result["Headcount"])
+	assert.Equal(t, "cakes", result["Code"])
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "/event/testevent/activities", nil))
+	recorded.CodeIs(200)
+	results := []map[string]interface{}{}
+	assert.NoError(t, recorded.DecodeJsonPayload(&results))
+	assert.Equal(t, float64(5), results[0]["Headcount"])
+
+	// ------------------------------------
+	// With a waiting list, groups which do not fit wait, groups larger than the capacity are refused
+	// ------------------------------------
+
+	details["Capacity"] = 6
+	details["WaitlistEnabled"] = true
+	details["ReopenWhenAvailable"] = true
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/cakes", details, token))
+	recorded.CodeIs(200)
+
+	assert.Equal(t, 200, addGroup(2).Code)
+	assert.Equal(t, 400, addGroup(7).Code)
+
+	activity = jeparticipe.ActivityService.GetOrCreateActivity("cakes", event.Code)
+	assert.Equal(t, entities.StateOpen, activity.State)
+	assert.Len(t, activity.Waitlist, 1)
+	assert.Equal(t, 2, activity.Waitlist[0].HeadCount())
+}
+
+func TestGetActivitiesActivityService(t *testing.T) {
+
+	jeparticipe, handler, event := apptest.CreateATestApp()
+	defer apptest.DeleteTestApp(jeparticipe)
+
+	// ------------------------------------
+	// Event does not exist, event without activities
+	// ------------------------------------
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "/event/donotexists/activities", nil))
+	recorded.CodeIs(404)
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "/event/testevent/activities", nil))
+	recorded.CodeIs(200)
+	recorded.BodyIs("[]")
+
+	// ------------------------------------
+	// Activities are sorted by order then code, private data is hidden
+	// ------------------------------------
+
+	for i, code := range []string{"cakes", "bar", "games"} {
+		activity := entities.NewActivity(code)
+		activity.Order = i % 2
+		activity.AddParticipant("public "+code, "private "+code, "111.111.111.111")
+		assert.NoError(t, jeparticipe.ActivityService.SaveActivity(activity, event.Code))
+	}
+
+	rq := test.MakeSimpleRequest("GET", "/event/testevent/activities", nil)
+	rq.Header.Set("X-Real-IP", "222.222.222.222")
+	recorded = test.RunRequest(t, handler, rq)
+	recorded.CodeIs(200)
+
+	activities := make([]*entities.Activity, 0)
+	assert.NoError(t, recorded.DecodeJsonPayload(&activities))
+	assert.Len(t, activities, 3)
+	assert.Equal(t, "cakes", activities[0].Code)
+	assert.Equal(t, "games", activities[1].Code)
+	assert.Equal(t, "bar", activities[2].Code)
+	assert.Equal(t, "public cakes", activities[0].Participants[0].PublicText)
+	assert.Equal(t, "", activities[0].Participants[0].PrivateText)
+
+	// ------------------------------------
+	// Event admin sees private data
+	// ------------------------------------
+
+	token := apptest.GetAdminTokenForEvent(t, &handler, event)
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("GET", "/event/testevent/activities", nil, token))
+	recorded.CodeIs(200)
+
+	activities = make([]*entities.Activity, 0)
+	assert.NoError(t, recorded.DecodeJsonPayload(&activities))
+	assert.Equal(t, "private bar", activities[2].Participants[0].PrivateText)
+}
+
+func TestLifecycleActivityService(t *testing.T) {
+
+	jeparticipe, handler, event := apptest.CreateATestApp()
+	defer apptest.DeleteTestApp(jeparticipe)
+
+	token := apptest.GetAdminTokenForEvent(t, &handler, event)
+	participant := map[string]string{"text": "public"}
+
+	// ------------------------------------
+	// Draft activities are only visible by the event admin
+	// ------------------------------------
+
+	recorded := test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/bar/state/draft", nil, token))
+	recorded.CodeIs(200)
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/cakes/state/open", nil, token))
+	recorded.CodeIs(200)
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "/event/testevent/activity/bar", nil))
+	recorded.CodeIs(404)
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("GET", "/event/testevent/activity/bar", nil, token))
+	recorded.CodeIs(200)
+
+	activities := make([]*entities.Activity, 0)
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "/event/testevent/activities", nil))
+	assert.NoError(t, recorded.DecodeJsonPayload(&activities))
+	assert.Len(t, activities, 1)
+	assert.Equal(t, "cakes", activities[0].Code)
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("PUT", "/event/testevent/activity/bar/participant", participant))
+	recorded.CodeIs(403)
+
+	// ------------------------------------
+	// Scheduled opening and closing
+	// ------------------------------------
+
+	openAt := time.Now().Add(time.Hour)
+	details := map[string]interface{}{"Title": "Bar", "OpenAt": openAt, "CloseAt": openAt.Add(24 * time.Hour)}
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/bar", details, token))
+	recorded.CodeIs(200)
+
+	invalid := map[string]interface{}{"OpenAt": openAt, "CloseAt": openAt.Add(-time.Hour)}
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/bar", invalid, token))
+	recorded.CodeIs(400)
+
+	changed, err := jeparticipe.ScheduleService.ApplySchedules(time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, changed)
+	assert.True(t, jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code).IsDraft())
+
+	changed, err = jeparticipe.ScheduleService.ApplySchedules(openAt)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, changed)
+	assert.True(t, jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code).IsOpen())
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("PUT", "/event/testevent/activity/bar/participant", participant))
+	recorded.CodeIs(200)
+
+	changed, err = jeparticipe.ScheduleService.ApplySchedules(openAt.Add(24 * time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, changed)
+	assert.Equal(t, entities.StateClosed, jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code).State)
+
+	// ------------------------------------
+	// Archived activities are read-only
+	// ------------------------------------
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/bar/state/archived", nil, token))
+	recorded.CodeIs(200)
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "/event/testevent/activity/bar", nil))
+	recorded.CodeIs(200)
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/bar/participant", participant, token))
+	recorded.CodeIs(403)
+	recorded.BodyIs("{\"Error\":\"Activity is archived\"}")
+
+	activity := jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code)
+	rq := apptest.MakeAdminRequest("GET", "/event/testevent/activity/bar/participant/"+activity.Participants[0].Code+"/delete", nil, token)
+	recorded = test.RunRequest(t, handler, rq)
+	recorded.CodeIs(403)
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/bar", details, token))
+	recorded.CodeIs(403)
+}
+
+func TestBulkChangeStateActivityService(t *testing.T) {
+
+	jeparticipe, handler, event := apptest.CreateATestApp()
+	defer apptest.DeleteTestApp(jeparticipe)
+
+	activities := map[string][]string{
+		"bar-morning":   {"bar"},
+		"bar-afternoon": {"bar", "afternoon"},
+		"cakes":         {"kitchen"},
+		"games":         {"afternoon"},
+	}
+	for code, tags := range activities {
+		activity := entities.NewActivity(code)
+		activity.Tags = tags
+		assert.NoError(t, jeparticipe.ActivityService.SaveActivity(activity, event.Code))
+	}
+	archived := entities.NewActivity("archived")
+	archived.State = entities.StateArchived
+	assert.NoError(t, jeparticipe.ActivityService.SaveActivity(archived, event.Code))
+
+	// ------------------------------------
+	// Same checks as a single state change
+	// ------------------------------------
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("PUT", "/event/donotexists/activities/state/close", nil))
+	recorded.CodeIs(404)
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("PUT", "/event/testevent/activities/state/test", nil))
+	recorded.CodeIs(400)
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("PUT", "/event/testevent/activities/state/close", nil))
+	recorded.CodeIs(403)
+
+	// ------------------------------------
+	// Filtered by code prefix, then by tag
+	// ------------------------------------
+
+	token := apptest.GetAdminTokenForEvent(t, &handler, event)
+	changeStates := func(query string) []*entities.Activity {
+		recorded := test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activities/state/close"+query, nil, token))
+		recorded.CodeIs(200)
+		changed := make([]*entities.Activity, 0)
+		assert.NoError(t, recorded.DecodeJsonPayload(&changed))
+		return changed
+	}
+
+	changed := changeStates("?prefix=bar-")
+	assert.Len(t, changed, 2)
+	assert.Equal(t, entities.StateClosed, jeparticipe.ActivityService.GetOrCreateActivity("bar-morning", event.Code).State)
+	assert.Equal(t, entities.StateOpen, jeparticipe.ActivityService.GetOrCreateActivity("games", event.Code).State)
+
+	changed = changeStates("?tag=afternoon")
+	assert.Len(t, changed, 1)
+	assert.Equal(t, "games", changed[0].Code)
+	assert.Equal(t, 2, changed[0].Revision)
+
+	// ------------------------------------
+	// All activities, archived ones are left unchanged
+	// ------------------------------------
+
+	changed = changeStates("")
+	assert.Len(t, changed, 1)
+	assert.Equal(t, "cakes", changed[0].Code)
+	assert.True(t, jeparticipe.ActivityService.GetOrCreateActivity("archived", event.Code).IsArchived())
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activities/state/open", nil, token))
+	recorded.CodeIs(200)
+	changed = make([]*entities.Activity, 0)
+	assert.NoError(t, recorded.DecodeJsonPayload(&changed))
+	assert.Len(t, changed, 4)
+}
+
+func TestFormActivityService(t *testing.T) {
+
+	jeparticipe, handler, event := apptest.CreateATestApp()
+	defer apptest.DeleteTestApp(jeparticipe)
+
+	// Participants are recognized by their sign-up IP
+	jeparticipe.ActivityService.IPFallback = true
+
+	token := apptest.GetAdminTokenForEvent(t, &handler, event)
+	form := []map[string]interface{}{
+		{"name": "phone", "type": "phone", "required": true},
+		{"name": "size", "type": "select", "options": []string{"S", "M", "L"}, "public": true},
+	}
+
+	invalidForm := []map[string]interface{}{{"name": "size", "type": "select"}}
+	recorded := test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/tshirts", map[string]interface{}{"Form": invalidForm}, token))
+	recorded.CodeIs(400)
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/tshirts", map[string]interface{}{"Form": form}, token))
+	recorded.CodeIs(200)
+
+	// ------------------------------------
+	// Submissions are validated against the form
+	// ------------------------------------
+
+	participant := map[string]interface{}{"text": "public", "answers": map[string]string{"size": "M"}}
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("PUT", "/event/testevent/activity/tshirts/participant", participant))
+	recorded.CodeIs(400)
+	recorded.BodyIs("{\"Error\":\"Field phone is required\"}")
+
+	participant["answers"] = map[string]string{"phone": "0600000000", "size": "XXL"}
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("PUT", "/event/testevent/activity/tshirts/participant", participant))
+	recorded.CodeIs(400)
+
+	participant["answers"] = map[string]string{"phone": "06 00 00 00 00", "size": "M"}
+	rq := test.MakeSimpleRequest("PUT", "/event/testevent/activity/tshirts/participant", participant)
+	rq.Header.Set("X-Real-IP", "111.111.111.111")
+	recorded = test.RunRequest(t, handler, rq)
+	recorded.CodeIs(200)
+
+	activity := jeparticipe.ActivityService.GetOrCreateActivity("tshirts", event.Code)
+	assert.Equal(t, "06 00 00 00 00", activity.Participants[0].Answers["phone"])
+
+	// ------------------------------------
+	// Private answers are hidden
+	// ------------------------------------
+
+	rq = test.MakeSimpleRequest("GET", "/event/testevent/activity/tshirts", nil)
+	rq.Header.Set("X-Real-IP", "222.222.222.222")
+	recorded = test.RunRequest(t, handler, rq)
+	activity = &entities.Activity{}
+	assert.NoError(t, recorded.DecodeJsonPayload(activity))
+	assert.Equal(t, map[string]string{"size": "M"}, activity.Participants[0].Answers)
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("GET", "/event/testevent/activity/tshirts", nil, token))
+	activity = &entities.Activity{}
+	assert.NoError(t, recorded.DecodeJsonPayload(activity))
+	assert.Equal(t, "06 00 00 00 00", activity.Participants[0].Answers["phone"])
+
+	// ------------------------------------
+	// Form can't change the answers already given or make them public
+	// ------------------------------------
+
+	form[0]["public"] = true
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/tshirts", map[string]interface{}{"Form": form}, token))
+	recorded.CodeIs(400)
+	form[0]["public"] = false
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/tshirts", map[string]interface{}{"Form": form[:1]}, token))
+	recorded.CodeIs(400)
+
+	form = append(form, map[string]interface{}{"name": "comment", "type": "text"})
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/tshirts", map[string]interface{}{"Form": form}, token))
+	recorded.CodeIs(200)
+
+	// ------------------------------------
+	// Activities without form do not accept answers
+	// ------------------------------------
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("PUT", "/event/testevent/activity/bar/participant", participant))
+	recorded.CodeIs(400)
+
+	// ------------------------------------
+	// Answers are updated with the same validation, and kept if not sent
+	// ------------------------------------
+
+	url := "/event/testevent/activity/tshirts/participant/" + activity.Participants[0].Code
+	updateRequest := func(update map[string]interface{}) *httptest.ResponseRecorder {
+		rq := test.MakeSimpleRequest("PUT", url, update)
+		rq.Header.Set("X-Real-IP", "111.111.111.111")
+		return test.RunRequest(t, handler, rq).Recorder
+	}
+
+	assert.Equal(t, 400, updateRequest(map[string]interface{}{"text": "public", "answers": map[string]string{"size": "L"}}).Code)
+	assert.Equal(t, 200, updateRequest(map[string]interface{}{"text": "public", "answers": map[string]string{"phone": "0611111111", "size": "L"}}).Code)
+	assert.Equal(t, map[string]string{"phone": "0611111111", "size": "L"}, jeparticipe.ActivityService.GetOrCreateActivity("tshirts", event.Code).Participants[0].Answers)
+
+	assert.Equal(t, 200, updateRequest(map[string]interface{}{"text": "updated", "admintext": strings.Repeat("a", 1000)}).Code)
+	updated := jeparticipe.ActivityService.GetOrCreateActivity("tshirts", event.Code).Participants[0]
+	assert.Equal(t, "updated", updated.PublicText)
+	assert.Equal(t, "L", updated.Answers["size"])
+
+	// ------------------------------------
+	// Activities with a form accept more data
+	// ------------------------------------
+
+	long := map[string]interface{}{"text": "public", "admintext": strings.Repeat("a", 1000), "answers": map[string]string{"phone": "0600000000"}}
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("PUT", "/event/testevent/activity/tshirts/participant", long))
+	recorded.CodeIs(200)
+
+	delete(long, "answers")
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("PUT", "/event/testevent/activity/bar/participant", long))
+	recorded.CodeIs(400)
+	recorded.BodyIs("{\"Error\":\"Participant data is limited to 512 characters.\"}")
+
+	long["admintext"] = strings.Repeat("a", 9000)
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("PUT", "/event/testevent/activity/tshirts/participant", long))
+	recorded.CodeIs(400)
+}
+
+func TestUpdateParticipantActivityService(t *testing.T) {
+
+	jeparticipe, handler, event := apptest.CreateATestApp()
+	defer apptest.DeleteTestApp(jeparticipe)
+
+	// Participants are recognized by their sign-up IP
+	jeparticipe.ActivityService.IPFallback = true
+
+	activity := jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code)
+	first := activity.AddParticipant("typo", "private", "111.111.111.111")
+	activity.AddParticipant("other", "private", "222.222.222.222")
+	deleted := activity.AddParticipant("deleted", "private", "111.111.111.111")
+	activity.RemoveParticipant(deleted.Code)
+	assert.NoError(t, jeparticipe.ActivityService.SaveActivity(activity, event.Code))
+
+	update := map[string]string{"text": "fixed", "admintext": "new private"}
+	url := "/event/testevent/activity/bar/participant/" + first.Code
+
+	// ------------------------------------
+	// Invalid requests
+	// ------------------------------------
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("PUT", "/event/donotexists/activity/bar/participant/"+first.Code, update))
+	recorded.CodeIs(404)
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("PUT", url, map[string]string{"text": ""}))
+	recorded.CodeIs(400)
+
+	// Without form, no answers and the smallest limit
+	rq := test.MakeSimpleRequest("PUT", url, map[string]interface{}{"text": "fixed", "answers": map[string]string{"size": "M"}})
+	rq.Header.Set("X-Real-IP", "111.111.111.111")
+	test.RunRequest(t, handler, rq).CodeIs(400)
+
+	rq = test.MakeSimpleRequest("PUT", url, map[string]string{"text": "fixed", "admintext": strings.Repeat("a", 600)})
+	rq.Header.Set("X-Real-IP", "111.111.111.111")
+	test.RunRequest(t, handler, rq).CodeIs(400)
+
+	rq = test.MakeSimpleRequest("PUT", "/event/testevent/activity/bar/participant/"+deleted.Code, update)
+	rq.Header.Set("X-Real-IP", "111.111.111.111")
+	recorded = test.RunRequest(t, handler, rq)
+	recorded.CodeIs(404)
+
+	// ------------------------------------
+	// Only the creator can update a participant
+	// ------------------------------------
+
+	rq = test.MakeSimpleRequest("PUT", url, update)
+	rq.Header.Set("X-Real-IP", "222.222.222.222")
+	recorded = test.RunRequest(t, handler, rq)
+	recorded.CodeIs(403)
+
+	rq = test.MakeSimpleRequest("PUT", url, update)
+	rq.Header.Set("X-Real-IP", "111.111.111.111")
+	recorded = test.RunRequest(t, handler, rq)
+	recorded.CodeIs(200)
+
+	activity = jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code)
+	assert.Equal(t, first.Code, activity.Participants[0].Code)
+	assert.Equal(t, "fixed", activity.Participants[0].PublicText)
+	assert.Equal(t, "new private", activity.Participants[0].PrivateText)
+	assert.True(t, first.CreatedAt.Equal(activity.Participants[0].CreatedAt))
+	assert.False(t, activity.Participants[0].UpdatedAt.IsZero())
+
+	// ------------------------------------
+	// Admin can update a participant of a closed activity
+	// ------------------------------------
+
+	activity.State = entities.StateClosed
+	assert.NoError(t, jeparticipe.ActivityService.SaveActivity(activity, event.Code))
+
+	rq = test.MakeSimpleRequest("PUT", url, update)
+	rq.Header.Set("X-Real-IP", "111.111.111.111")
+	recorded = test.RunRequest(t, handler, rq)
+	recorded.CodeIs(403)
+
+	token := apptest.GetAdminTokenForEvent(t, &handler, event)
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", url, map[string]string{"text": "by admin"}, token))
+	recorded.CodeIs(200)
+	assert.Equal(t, "by admin", jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code).Participants[0].PublicText)
+}
+
+func TestMoveParticipantActivityService(t *testing.T) {
+
+	jeparticipe, handler, event := apptest.CreateATestApp()
+	defer apptest.DeleteTestApp(jeparticipe)
+
+	source := jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code)
+	source.Capacity = 1
+	source.WaitlistEnabled = true
+	moved := source.AddParticipant("moved", "private", "111.111.111.111")
+	waiting := source.AddToWaitlist("waiting", "private", "222.222.222.222")
+	source.State = entities.StateClosed
+	source.AutoClosed = true
+	assert.NoError(t, jeparticipe.ActivityService.SaveActivity(source, event.Code))
+
+	target := jeparticipe.ActivityService.GetOrCreateActivity("cakes", event.Code)
+	target.Capacity = 1
+	target.AddParticipant("full", "private", "333.333.333.333")
+	assert.NoError(t, jeparticipe.ActivityService.SaveActivity(target, event.Code))
+
+	draft := jeparticipe.ActivityService.GetOrCreateActivity("draft", event.Code)
+	draft.State = entities.StateDraft
+	assert.NoError(t, jeparticipe.ActivityService.SaveActivity(draft, event.Code))
+
+	withform := jeparticipe.ActivityService.GetOrCreateActivity("withform", event.Code)
+	withform.Form = []*entities.FormField{{Name: "phone", Type: entities.FieldPhone, Required: true}}
+	assert.NoError(t, jeparticipe.ActivityService.SaveActivity(withform, event.Code))
+
+	url := "/event/testevent/activity/bar/participant/" + moved.Code + "/move/"
+	token := apptest.GetAdminTokenForEvent(t, &handler, event)
+
+	// ------------------------------------
+	// Invalid requests
+	// ------------------------------------
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("PUT", url+"cakes", nil))
+	recorded.CodeIs(403)
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/donotexists/activity/bar/participant/"+moved.Code+"/move/cakes", nil, token))
+	recorded.CodeIs(404)
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", url+"bar", nil, token))
+	recorded.CodeIs(400)
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/bar/participant/unknown/move/cakes", nil, token))
+	recorded.CodeIs(404)
+
+	// ------------------------------------
+	// Target activity must be published and accept the answers
+	// ------------------------------------
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", url+"draft", nil, token))
+	recorded.CodeIs(403)
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", url+"withform", nil, token))
+	recorded.CodeIs(400)
+	assert.Len(t, jeparticipe.ActivityService.GetOrCreateActivity("withform", event.Code).Participants, 0)
+
+	// ------------------------------------
+	// Target activity is full, nothing changes
+	// ------------------------------------
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", url+"cakes", nil, token))
+	recorded.CodeIs(400)
+	assert.Len(t, jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code).Participants, 1)
+	assert.Len(t, jeparticipe.ActivityService.GetOrCreateActivity("cakes", event.Code).Participants, 1)
+
+	// ------------------------------------
+	// Move to an activity without participants yet, the first waitlisted participant is promoted
+	// ------------------------------------
+
+	activities, err := jeparticipe.ActivityService.GetAllActivities(event.Code)
+	assert.NoError(t, err)
+	assert.Len(t, activities, 4)
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", url+"wine", nil, token))
+	recorded.CodeIs(200)
+
+	result := map[string]*entities.Activity{}
+	assert.NoError(t, recorded.DecodeJsonPayload(&result))
+	assert.Equal(t, "bar", result["from"].Code)
+	assert.Equal(t, "wine", result["to"].Code)
+
+	source = jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code)
+	assert.Len(t, source.Participants, 1)
+	assert.Equal(t, waiting.Code, source.Participants[0].Code)
+	assert.Len(t, source.Waitlist, 0)
+	assert.Equal(t, entities.StateClosed, source.State)
+
+	wine := jeparticipe.ActivityService.GetOrCreateActivity("wine", event.Code)
+	assert.Len(t, wine.Participants, 1)
+	assert.Equal(t, moved.Code, wine.Participants[0].Code)
+	assert.True(t, moved.CreatedAt.Equal(wine.Participants[0].CreatedAt))
+	assert.Len(t, wine.Participants[0].History, 1)
+	assert.Equal(t, "bar", wine.Participants[0].History[0].From)
+	assert.Equal(t, "wine", wine.Participants[0].History[0].To)
+
+	// ------------------------------------
+	// Archived activities can't be changed
+	// ------------------------------------
+
+	wine.State = entities.StateArchived
+	assert.NoError(t, jeparticipe.ActivityService.SaveActivity(wine, event.Code))
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/wine/participant/"+moved.Code+"/move/bar", nil, token))
+	recorded.CodeIs(403)
+}
+
+func TestParticipantTokenActivityService(t *testing.T) {
+
+	jeparticipe, handler, event := apptest.CreateATestApp()
+	defer apptest.DeleteTestApp(jeparticipe)
+
+	// ------------------------------------
+	// Sign up returns the participant token, only once
+	// ------------------------------------
+
+	rq := test.MakeSimpleRequest("PUT", "/event/testevent/activity/bar/participant", map[string]string{"text": "public", "admintext": "private"})
+	rq.Header.Set("X-Real-IP", "111.111.111.111")
+	recorded := test.RunRequest(t, handler, rq)
+	recorded.CodeIs(200)
+
+	activity := &entities.Activity{}
+	assert.NoError(t, recorded.DecodeJsonPayload(&activity))
+	participant := activity.Participants[0]
+	assert.NotEmpty(t, participant.Token)
+	assert.Equal(t, "private", participant.PrivateText)
+	assert.Empty(t, jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code).Participants[0].Token)
+
+	url := "/event/testevent/activity/bar/participant/" + participant.Code
+
+	// ------------------------------------
+	// Same IP without the token is not enough, IP fallback is disabled by default
+	// ------------------------------------
+
+	rq = test.MakeSimpleRequest("GET", "/event/testevent/activity/bar", nil)
+	rq.Header.Set("X-Real-IP", "111.111.111.111")
+	recorded = test.RunRequest(t, handler, rq)
+	assert.NoError(t, recorded.DecodeJsonPayload(&activity))
+	assert.Empty(t, activity.Participants[0].PrivateText)
+
+	rq = test.MakeSimpleRequest("PUT", url, map[string]string{"text": "fixed"})
+	rq.Header.Set("X-Real-IP", "111.111.111.111")
+	test.RunRequest(t, handler, rq).CodeIs(403)
+
+	rq = test.MakeSimpleRequest("GET", url+"/delete", nil)
+	rq.Header.Set("X-Participant-Token", "invalid")
+	test.RunRequest(t, handler, rq).CodeIs(403)
+
+	// ------------------------------------
+	// The token unlocks private data, edit and cancel from any IP
+	// ------------------------------------
+
+	rq = test.MakeSimpleRequest("GET", "/event/testevent/activity/bar", nil)
+	rq.Header.Set("X-Participant-Token", participant.Token)
+	recorded = test.RunRequest(t, handler, rq)
+	assert.NoError(t, recorded.DecodeJsonPayload(&activity))
+	assert.Equal(t, "private", activity.Participants[0].PrivateText)
+
+	rq = test.MakeSimpleRequest("PUT", url, map[string]string{"text": "fixed"})
+	rq.Header.Set("X-Participant-Token", participant.Token)
+	test.RunRequest(t, handler, rq).CodeIs(200)
+
+	// A token is only valid for its own event
+	otherEvent, _ := entities.NewPendingConfirmationEvent("otherevent", "ip", "test@test.com")
+	jeparticipe.EventService.ConfirmAndSaveEvent(otherEvent)
+	other := jeparticipe.ActivityService.GetOrCreateActivity("bar", otherEvent.Code)
+	other.Participants = append(other.Participants, participant)
+	assert.NoError(t, jeparticipe.ActivityService.SaveActivity(other, otherEvent.Code))
+	rq = test.MakeSimpleRequest("GET", "/event/otherevent/activity/bar/participant/"+participant.Code+"/delete", nil)
+	rq.Header.Set("X-Participant-Token", participant.Token)
+	test.RunRequest(t, handler, rq).CodeIs(403)
+
+	// The token is not accepted in the URL
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", url+"/delete?token="+participant.Token, nil))
+	recorded.CodeIs(403)
+
+	rq = test.MakeSimpleRequest("GET", url+"/delete", nil)
+	rq.Header.Set("X-Participant-Token", participant.Token)
+	test.RunRequest(t, handler, rq).CodeIs(200)
+	assert.Equal(t, 0, jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code).CountParticipants())
+}
+
+func TestRevisionActivityService(t *testing.T) {
+
+	jeparticipe, handler, event := apptest.CreateATestApp()
+	defer apptest.DeleteTestApp(jeparticipe)
+
+	// ------------------------------------
+	// A new activity has no revision yet
+	// ------------------------------------
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "/event/testevent/activity/testrevision", nil))
+	recorded.CodeIs(200)
+	recorded.HeaderIs("ETag", `"0"`)
+
+	// ------------------------------------
+	// Each update increments the revision
+	// ------------------------------------
+
+	data := &map[string]string{"text": "public", "admintext": "private"}
+	rq := test.MakeSimpleRequest("PUT", "/event/testevent/activity/testrevision/participant", data)
+	rq.Header.Set("If-Match", `"0"`)
+	recorded = test.RunRequest(t, handler, rq)
+	recorded.CodeIs(200)
+	recorded.HeaderIs("ETag", `"1"`)
+
+	activity := &entities.Activity{}
+	assert.NoError(t, recorded.DecodeJsonPayload(&activity))
+	assert.Equal(t, 1, activity.Revision)
+
+	// ------------------------------------
+	// Stale revisions are rejected
+	// ------------------------------------
+
+	rq = test.MakeSimpleRequest("PUT", "/event/testevent/activity/testrevision/participant", data)
+	rq.Header.Set("If-Match", `"0"`)
+	recorded = test.RunRequest(t, handler, rq)
+	recorded.CodeIs(412)
+	recorded.BodyIs(`{"Error":"Activity has been modified"}`)
+
+	rq = test.MakeSimpleRequest("GET", "/event/testevent/activity/testrevision/participant/"+activity.Participants[0].Code+"/delete", nil)
+	rq.Header.Set("If-Match", `"0"`)
+	recorded = test.RunRequest(t, handler, rq)
+	recorded.CodeIs(412)
+
+	token := apptest.GetAdminTokenForEvent(t, &handler, event)
+	rq = apptest.MakeAdminRequest("PUT", "/event/testevent/activity/testrevision/state/close", nil, token)
+	rq.Header.Set("If-Match", `"0"`)
+	recorded = test.RunRequest(t, handler, rq)
+	recorded.CodeIs(412)
+
+	activity = jeparticipe.ActivityService.GetOrCreateActivity("testrevision", event.Code)
+	assert.Equal(t, 1, activity.Revision)
+	assert.Len(t, activity.Participants, 1)
+	assert.True(t, activity.IsOpen())
+
+	// ------------------------------------
+	// Current revision is accepted
+	// ------------------------------------
+
+	rq = apptest.MakeAdminRequest("PUT", "/event/testevent/activity/testrevision/state/close", nil, token)
+	rq.Header.Set("If-Match", `"1"`)
+	recorded = test.RunRequest(t, handler, rq)
+	recorded.CodeIs(200)
+	recorded.HeaderIs("ETag", `"2"`)
+}
+
+func TestConcurrentAddParticipantActivityService(t *testing.T) {
+	defer os.Remove("concurrent.db")
+	defer os.Remove("concurrent.sqlite")
+
+	stores := map[string]services.Store{
+		"bolt":   services.NewRepositoryService("concurrent.db"),
+		"sqlite": services.NewSqliteStore("concurrent.sqlite"),
+		"memory": services.NewMemoryStore(),
+	}
+
+	for name, store := range stores {
+		jeparticipe, handler, event := apptest.CreateATestAppWithStore(store)
+
+		// Participants are recognized by their sign-up IP
+		jeparticipe.ActivityService.IPFallback = true
+
+		// ------------------------------------
+		// Many volunteers sign up at the same time
+		// ------------------------------------
+
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				data := &map[string]string{"text": "public", "admintext": "private"}
+				recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("PUT", "/event/testevent/activity/testconcurrent/participant", data))
+				recorded.CodeIs(200)
+			}()
+		}
+		wg.Wait()
+
+		activity := jeparticipe.ActivityService.GetOrCreateActivity("testconcurrent", event.Code)
+		assert.Len(t, activity.Participants, 50, "Participants lost with the %s store", name)
+
+		// ------------------------------------
+		// Sign ups and cancellations at the same time
+		// ------------------------------------
+
+		for i := 0; i < 25; i++ {
+			wg.Add(2)
+			go func(code string) {
+				defer wg.Done()
+				rq := test.MakeSimpleRequest("GET", "/event/testevent/activity/testconcurrent/participant/"+code+"/delete", nil)
+				recorded := test.RunRequest(t, handler, rq)
+				recorded.CodeIs(200)
+			}(activity.Participants[i].Code)
+			go func() {
+				defer wg.Done()
+				data := &map[string]string{"text": "public", "admintext": "private"}
+				recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("PUT", "/event/testevent/activity/testconcurrent/participant", data))
+				recorded.CodeIs(200)
+			}()
+		}
+		wg.Wait()
+
+		activity = jeparticipe.ActivityService.GetOrCreateActivity("testconcurrent", event.Code)
+		activity.RemovePrivateData("")
+		assert.Len(t, activity.Participants, 50, "Participants lost with the %s store", name)
+
+		apptest.DeleteTestApp(jeparticipe)
+	}
+}
@@ -0,0 +1,177 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/boltdb/bolt"
+	"github.com/julienbayle/jeparticipe/entities"
+)
+
+const (
+	// Suffix of the copy of the database kept when a backup is restored
+	BeforeRestoreSuffix = ".before-restore"
+)
+
+// Restore replaces the database with an uploaded backup (raw BoltDB file as request body)
+func (rs *RepositoryService) Restore(w rest.ResponseWriter, r *rest.Request) {
+	if !hasPermission(r, PermissionSuperAdmin) {
+		rest.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Upload is written next to the database so that it can be renamed to the database path
+	upload, err := ioutil.TempFile(filepath.Dir(rs.Path()), "restore-")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(upload.Name())
+
+	_, err = io.Copy(upload, r.Body)
+	r.Body.Close()
+	upload.Close()
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = ValidateBackup(upload.Name()); err != nil {
+		rest.Error(w, "Invalid backup : "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = rs.restore(upload.Name()); err != nil {
+		panic(err)
+	}
+}
+
+// restore closes the database, installs the backup file and opens the database again
+func (rs *RepositoryService) restore(backupFilePath string) error {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	dbFilePath := rs.db.Path()
+	if err := rs.db.Close(); err != nil {
+		return err
+	}
+
+	installErr := installBackup(backupFilePath, dbFilePath)
+
+	// Database is reopened even if the installation failed (previous file is then still in place)
+	Db, err := bolt.Open(dbFilePath, 0600, nil)
+	if err != nil {
+		panic("Unable to open database after restore " + err.Error())
+	}
+	rs.db = Db
+
+	return installErr
+}
+
+// RestoreBackup validates a backup file and copies it over a database which must not be in use
+func RestoreBackup(backupFilePath string, dbFilePath string) error {
+	if err := ValidateBackup(backupFilePath); err != nil {
+		return err
+	}
+
+	// Database lock ensures that no server is using it
+	if _, err := os.Stat(dbFilePath); err == nil {
+		db, err := bolt.Open(dbFilePath, 0600, &bolt.Options{Timeout: time.Second})
+		if err != nil {
+			return errors.New("Database " + dbFilePath + " is in use, stop the server first")
+		}
+		db.Close()
+	}
+
+	backup, err := os.Open(backupFilePath)
+	if err != nil {
+		return err
+	}
+	defer backup.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dbFilePath), "restore-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, backup)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return installBackup(tmp.Name(), dbFilePath)
+}
+
+// installBackup moves a backup file to the database path, previous database is kept with the BeforeRestoreSuffix
+func installBackup(backupFilePath string, dbFilePath string) error {
+	if _, err := os.Stat(dbFilePath); err == nil {
+		if err := os.Rename(dbFilePath, dbFilePath+BeforeRestoreSuffix); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(backupFilePath, dbFilePath); err != nil {
+		os.Rename(dbFilePath+BeforeRestoreSuffix, dbFilePath)
+		return err
+	}
+
+	return os.Chmod(dbFilePath, 0600)
+}
+
+// ValidateBackup checks that a file is a BoltDB database with valid events and activities
+func ValidateBackup(backupFilePath string) error {
+	// Bolt creates missing files, even in read-only mode
+	if _, err := os.Stat(backupFilePath); err != nil {
+		return err
+	}
+
+	db, err := bolt.Open(backupFilePath, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		for _, bucket := range []string{EventsBucketName, PropertiesBucketName} {
+			if tx.Bucket([]byte(bucket)) == nil {
+				return errors.New("Missing collection " + bucket)
+			}
+		}
+
+		err := tx.Bucket([]byte(EventsBucketName)).ForEach(func(k, v []byte) error {
+			event := &entities.Event{}
+			if err := json.Unmarshal(v, event); err != nil {
+				return errors.New("Invalid event " + string(k) + " " + err.Error())
+			}
+			if event.EmailConfirmed && tx.Bucket([]byte(GetActivityBucketName(event.Code))) == nil {
+				return errors.New("Missing activities collection for event " + event.Code)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if !strings.HasPrefix(string(name), GetActivityBucketName("")) {
+				return nil
+			}
+			return b.ForEach(func(k, v []byte) error {
+				activity := &entities.Activity{}
+				if err := json.Unmarshal(v, activity); err != nil {
+					return errors.New("Invalid activity " + string(name) + "/" + string(k) + " " + err.Error())
+				}
+				return nil
+			})
+		})
+	})
+}
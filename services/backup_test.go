@@ -0,0 +1,181 @@
+package services_test
+
+import (
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"github.com/boltdb/bolt"
+	"github.com/julienbayle/jeparticipe/app/test"
+	"github.com/julienbayle/jeparticipe/entities"
+	"github.com/julienbayle/jeparticipe/services"
+	"github.com/stretchr/testify/assert"
+
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// makeRestoreRequest sends a raw file to the restore endpoint
+func makeRestoreRequest(data []byte, token string) *http.Request {
+	rq, _ := http.NewRequest("POST", "/backup/restore", bytes.NewReader(data))
+	rq.Header.Set("Content-Type", "application/octet-stream")
+	if token != "" {
+		rq.Header.Set("Authorization", "Bearer "+token)
+	}
+	return rq
+}
+
+// makeBoltFile creates a bolt file using the given function and returns its content
+func makeBoltFile(t *testing.T, fn func(tx *bolt.Tx) error) []byte {
+	defer os.Remove("invalid.db")
+	db, err := bolt.Open("invalid.db", 0600, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Update(fn))
+	db.Close()
+
+	data, err := ioutil.ReadFile("invalid.db")
+	assert.NoError(t, err)
+	return data
+}
+
+func TestRestore(t *testing.T) {
+	jeparticipe, handler, event := apptest.CreateATestAppWithStore(services.NewRepositoryService("restore.db"))
+	defer os.Remove("restore.db" + services.BeforeRestoreSuffix)
+	defer os.Remove("restore.db")
+	defer apptest.DeleteTestApp(jeparticipe)
+
+	superAdminToken := apptest.GetSuperAdminToken(t, &handler, jeparticipe)
+
+	// ------------------------------------
+	// Take a backup
+	// ------------------------------------
+
+	activity := jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code)
+	activity.AddParticipant("public", "private", "ip")
+	assert.NoError(t, jeparticipe.ActivityService.SaveActivity(activity, event.Code))
+
+	recorded := test.RunRequest(t, handler, apptest.MakeAdminRequest("GET", "/backup", nil, superAdminToken))
+	recorded.CodeIs(200)
+	backup := recorded.Recorder.Body.Bytes()
+
+	// ------------------------------------
+	// Changes after the backup
+	// ------------------------------------
+
+	eventAfterBackup, _ := entities.NewPendingConfirmationEvent("afterbackup", "ip", "test@test.com")
+	assert.NoError(t, jeparticipe.EventService.ConfirmAndSaveEvent(eventAfterBackup))
+	assert.NotNil(t, jeparticipe.EventService.GetEvent("afterbackup"))
+
+	// ------------------------------------
+	// Restore without permission
+	// ------------------------------------
+
+	recorded = test.RunRequest(t, handler, makeRestoreRequest(backup, ""))
+	recorded.CodeIs(403)
+
+	adminToken := apptest.GetAdminTokenForEvent(t, &handler, event)
+	recorded = test.RunRequest(t, handler, makeRestoreRequest(backup, adminToken))
+	recorded.CodeIs(403)
+
+	// ------------------------------------
+	// Restore invalid files
+	// ------------------------------------
+
+	recorded = test.RunRequest(t, handler, makeRestoreRequest([]byte("not a database"), superAdminToken))
+	recorded.CodeIs(400)
+
+	noBuckets := makeBoltFile(t, func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte(services.PropertiesBucketName))
+		return err
+	})
+	recorded = test.RunRequest(t, handler, makeRestoreRequest(noBuckets, superAdminToken))
+	recorded.CodeIs(400)
+	recorded.BodyIs(`{"Error":"Invalid backup : Missing collection events"}`)
+
+	invalidActivity := makeBoltFile(t, func(tx *bolt.Tx) error {
+		tx.CreateBucket([]byte(services.PropertiesBucketName))
+		tx.CreateBucket([]byte(services.EventsBucketName))
+		b, _ := tx.CreateBucket([]byte(services.GetActivityBucketName("testevent")))
+		return b.Put([]byte("bar"), []byte("{invalid"))
+	})
+	recorded = test.RunRequest(t, handler, makeRestoreRequest(invalidActivity, superAdminToken))
+	recorded.CodeIs(400)
+
+	assert.NotNil(t, jeparticipe.EventService.GetEvent("afterbackup"))
+
+	// ------------------------------------
+	// Restore the backup
+	// ------------------------------------
+
+	recorded = test.RunRequest(t, handler, makeRestoreRequest(backup, superAdminToken))
+	recorded.CodeIs(200)
+
+	assert.Nil(t, jeparticipe.EventService.GetEvent("afterbackup"))
+	assert.NotNil(t, jeparticipe.EventService.GetEvent(event.Code))
+	activity = jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code)
+	assert.Len(t, activity.Participants, 1)
+
+	_, err := os.Stat("restore.db" + services.BeforeRestoreSuffix)
+	assert.NoError(t, err)
+}
+
+func TestOfflineRestore(t *testing.T) {
+	defer os.Remove("offline.db")
+	defer os.Remove("offline.db" + services.BeforeRestoreSuffix)
+	defer os.Remove("offline-backup.db")
+
+	backup := makeBoltFile(t, func(tx *bolt.Tx) error {
+		tx.CreateBucket([]byte(services.PropertiesBucketName))
+		b, _ := tx.CreateBucket([]byte(services.EventsBucketName))
+		return b.Put([]byte("pending"), []byte(`{"Code":"pending"}`))
+	})
+	assert.NoError(t, ioutil.WriteFile("offline-backup.db", backup, 0600))
+
+	// Database in use
+	repositoryService := services.NewRepositoryService("offline.db")
+	assert.Error(t, services.RestoreBackup("offline-backup.db", "offline.db"))
+	repositoryService.ShutDown()
+
+	// Invalid backup
+	assert.Error(t, services.RestoreBackup("donotexist.db", "offline.db"))
+
+	// Valid backup
+	assert.NoError(t, services.RestoreBackup("offline-backup.db", "offline.db"))
+
+	repositoryService = services.NewRepositoryService("offline.db")
+	defer repositoryService.ShutDown()
+	event := &entities.Event{}
+	assert.NoError(t, repositoryService.GetDocument(services.EventsBucketName, "pending", event))
+	assert.Equal(t, "pending", event.Code)
+}
+
+func TestGetSnapshots(t *testing.T) {
+	jeparticipe, handler, event := apptest.CreateATestAppWithStore(services.NewRepositoryService("snapshots.db"))
+	defer os.Remove("snapshots.db")
+	defer os.RemoveAll("apisnapshots")
+	defer apptest.DeleteTestApp(jeparticipe)
+
+	assert.NoError(t, jeparticipe.StartSnapshots("apisnapshots", time.Hour, 7, 4))
+	handler = jeparticipe.BuildApi("test", "").MakeHandler()
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "/backup/snapshots", nil))
+	recorded.CodeIs(403)
+
+	token := apptest.GetAdminTokenForEvent(t, &handler, event)
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("GET", "/backup/snapshots", nil, token))
+	recorded.CodeIs(403)
+
+	token = apptest.GetSuperAdminToken(t, &handler, jeparticipe)
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("GET", "/backup/snapshots", nil, token))
+	recorded.CodeIs(200)
+
+	snapshots := make([]*services.Snapshot, 0)
+	assert.NoError(t, recorded.DecodeJsonPayload(&snapshots))
+	assert.Len(t, snapshots, 1)
+
+	// Snapshots are not available with other stores
+	memoryApp, _, _ := apptest.CreateATestApp()
+	defer apptest.DeleteTestApp(memoryApp)
+	assert.Error(t, memoryApp.StartSnapshots("apisnapshots", time.Hour, 7, 4))
+}
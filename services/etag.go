@@ -0,0 +1,28 @@
+package services
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+// etag converts a document revision to an HTTP entity tag
+func etag(revision int) string {
+	return `"` + strconv.Itoa(revision) + `"`
+}
+
+// ifMatch checks the optional If-Match request header against the current revision of a document
+func ifMatch(r *rest.Request, revision int) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" || header == "*" {
+		return true
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag(revision) {
+			return true
+		}
+	}
+	return false
+}
@@ -5,6 +5,9 @@ import (
 	"io/ioutil"
 	"net/http"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/ant0ine/go-json-rest/rest"
 	"github.com/julienbayle/jeparticipe/email"
@@ -12,17 +15,126 @@ import (
 )
 
 const (
-	EventsBucketName = "events"
+	EventsBucketName     = "events"
+	TombstonesBucketName = "tombstones"
+
+	// Default delay before the code of a deleted event can be reused
+	DefaultCoolingOff = 30 * 24 * time.Hour
+
+	// Default delay for the confirmation of a new event
+	DefaultPendingExpiry = 48 * time.Hour
+
+	// Default validity of a login link sent by email and of a JWT token
+	DefaultLoginLinkExpiry = time.Hour
+	DefaultTokenTimeout    = time.Hour
+
+	// Default and maximum number of events returned by a listing
+	DefaultEventListLimit = 50
+	MaxEventListLimit     = 500
 )
 
 type EventService struct {
-	RepositoryService *RepositoryService
-	EmailRelay        *email.EmailRelay
-	Secret            string
+	Store      Store
+	EmailRelay *email.EmailRelay
+	Secret     string
+
+	// Delay before the code of a deleted event can be reused
+	CoolingOff time.Duration
+
+	// Delay after which an unconfirmed event expires (0 means never)
+	PendingExpiry time.Duration
+
+	// Validity of a login link sent by email
+	LoginLinkExpiry time.Duration
+
+	// Validity of a JWT token
+	TokenTimeout time.Duration
+}
+
+// EventFilter selects events in a listing (zero values do not filter)
+type EventFilter struct {
+	Confirmed     *bool
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Email         string
+}
+
+type EventList struct {
+	Total  int               `json:"total"`
+	Offset int               `json:"offset"`
+	Limit  int               `json:"limit"`
+	Events []*entities.Event `json:"events"`
+}
+
+// GetEvents lists events, sorted by code (superadmin only)
+// Query parameters : confirmed (true|false), from and to (creation date, RFC3339 or YYYY-MM-DD), email, offset and limit
+func (es *EventService) GetEvents(w rest.ResponseWriter, r *rest.Request) {
+	if !hasPermission(r, PermissionSuperAdmin) {
+		rest.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := &EventFilter{Email: query.Get("email")}
+	var err error
+
+	if confirmed := query.Get("confirmed"); confirmed != "" {
+		value, err := strconv.ParseBool(confirmed)
+		if err != nil {
+			rest.Error(w, "Invalid confirmed parameter", http.StatusBadRequest)
+			return
+		}
+		filter.Confirmed = &value
+	}
+
+	if filter.CreatedAfter, err = parseDateParam(query.Get("from"), false); err != nil {
+		rest.Error(w, "Invalid from parameter", http.StatusBadRequest)
+		return
+	}
+
+	if filter.CreatedBefore, err = parseDateParam(query.Get("to"), true); err != nil {
+		rest.Error(w, "Invalid to parameter", http.StatusBadRequest)
+		return
+	}
+
+	offset, err := parseIntParam(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		rest.Error(w, "Invalid offset parameter", http.StatusBadRequest)
+		return
+	}
+
+	limit, err := parseIntParam(query.Get("limit"), DefaultEventListLimit)
+	if err != nil || limit < 1 || limit > MaxEventListLimit {
+		rest.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+		return
+	}
+
+	events, err := es.ListEvents(filter)
+	if err != nil {
+		panic(err)
+	}
+
+	list := &EventList{
+		Total:  len(events),
+		Offset: offset,
+		Limit:  limit,
+		Events: make([]*entities.Event, 0),
+	}
+	for i := offset; i < len(events) && i < offset+limit; i++ {
+		events[i].RemoveSecrets()
+		list.Events = append(list.Events, events[i])
+	}
+
+	w.WriteJson(list)
 }
 
 // GetEventStatus returns an event state (can be used to check if an event code is used or not)
 func (es *EventService) GetEventStatus(w rest.ResponseWriter, r *rest.Request) {
+	if !hasPermission(r, PermissionPublic) {
+		rest.Error(w, "Access forbidden", http.StatusForbidden)
+		return
+	}
+
 	eventCode := getEventCodeFromRequest(r)
 	event := es.GetEvent(eventCode)
 
@@ -34,8 +146,13 @@ func (es *EventService) GetEventStatus(w rest.ResponseWriter, r *rest.Request) {
 	w.WriteJson(map[string]bool{"confirmed": event.EmailConfirmed})
 }
 
-// GetEventConfig returns the config field value
+// GetEventConfig returns the config field value (public, the front-end reads it to display the event)
 func (es *EventService) GetEventConfig(w rest.ResponseWriter, r *rest.Request) {
+	if !hasPermission(r, PermissionPublic) {
+		rest.Error(w, "Access forbidden", http.StatusForbidden)
+		return
+	}
+
 	eventCode := getEventCodeFromRequest(r)
 	event := es.GetEvent(eventCode)
 
@@ -49,6 +166,8 @@ func (es *EventService) GetEventConfig(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 
+	w.Header().Set("ETag", etag(event.Revision))
+
 	if event.Config == nil {
 		w.WriteJson(map[string]string{})
 		return
@@ -73,7 +192,7 @@ func (es *EventService) SetEventConfig(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 
-	if !hasAdminPriviledge(r) {
+	if !hasPermission(r, PermissionManageEvent) {
 		rest.Error(w, "Access forbidden", http.StatusForbidden)
 		return
 	}
@@ -95,24 +214,36 @@ func (es *EventService) SetEventConfig(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 
-	event.Config = config
-
 	d := &map[string]interface{}{}
-	err = json.Unmarshal(event.Config, d)
+	err = json.Unmarshal(config, d)
 	if err != nil {
 		rest.Error(w, "Not a valid JSON document", http.StatusBadRequest)
 		return
 	}
 
-	err = es.SaveEvent(event)
+	event, err = es.UpdateEvent(eventCode, func(event *entities.Event) error {
+		if !ifMatch(r, event.Revision) {
+			return &requestError{"Event has been modified", http.StatusPreconditionFailed}
+		}
+		event.Config = config
+		event.Revision++
+		return nil
+	})
 	if err != nil {
-		panic(err)
+		writeError(w, err)
 		return
 	}
+
+	w.Header().Set("ETag", etag(event.Revision))
 }
 
 // CreatePendingEvent creates a new pending confirmation event
 func (es *EventService) CreatePendingEvent(w rest.ResponseWriter, r *rest.Request) {
+	if !hasPermission(r, PermissionPublic) {
+		rest.Error(w, "Access forbidden", http.StatusForbidden)
+		return
+	}
+
 	eventPayload := &entities.Event{}
 	err := r.DecodeJsonPayload(&eventPayload)
 
@@ -121,12 +252,19 @@ func (es *EventService) CreatePendingEvent(w rest.ResponseWriter, r *rest.Reques
 		return
 	}
 
+	// An expired pending event does not hold its code anymore
 	eventExist := es.GetEvent(eventPayload.Code)
-	if eventExist != nil {
+	if eventExist != nil && !eventExist.IsExpired(es.PendingExpiry) {
 		rest.Error(w, "An event with this code already exists", http.StatusForbidden)
 		return
 	}
 
+	tombstone := es.GetTombstone(eventPayload.Code)
+	if tombstone != nil && time.Since(tombstone.DeletedAt) < es.CoolingOff {
+		rest.Error(w, "An event with this code has been deleted recently", http.StatusForbidden)
+		return
+	}
+
 	event, err := entities.NewPendingConfirmationEvent(eventPayload.Code, getIp(r), eventPayload.UserEmail)
 	if err != nil {
 		rest.Error(w, err.Error(), http.StatusNotAcceptable)
@@ -147,10 +285,46 @@ func (es *EventService) CreatePendingEvent(w rest.ResponseWriter, r *rest.Reques
 		panic(err)
 		return
 	}
+
+	if tombstone != nil {
+		if err = es.Store.DeleteDocument(TombstonesBucketName, tombstone.Code); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// DeleteEvent removes an event and all its activities (event owners)
+func (es *EventService) DeleteEvent(w rest.ResponseWriter, r *rest.Request) {
+	eventCode := getEventCodeFromRequest(r)
+	event := es.GetEvent(eventCode)
+
+	if event == nil {
+		rest.Error(w, "Invalid code", http.StatusNotFound)
+		return
+	}
+
+	if !hasPermission(r, PermissionManageEvent) {
+		rest.Error(w, "Access forbidden", http.StatusForbidden)
+		return
+	}
+
+	tombstone := &entities.Tombstone{
+		Code:      event.Code,
+		DeletedAt: time.Now(),
+		DeletedBy: r.Env["REMOTE_USER"].(string),
+	}
+	if err := es.RemoveEvent(tombstone); err != nil {
+		panic(err)
+	}
 }
 
 // ConfirmEvent validates an event (link from a event confirmation email)
 func (es *EventService) ConfirmEvent(w rest.ResponseWriter, r *rest.Request) {
+	if !hasPermission(r, PermissionPublic) {
+		rest.Error(w, "Access forbidden", http.StatusForbidden)
+		return
+	}
+
 	eventCode := getEventCodeFromRequest(r)
 	event := es.GetEvent(eventCode)
 
@@ -164,6 +338,11 @@ func (es *EventService) ConfirmEvent(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 
+	if event.IsExpired(es.PendingExpiry) {
+		rest.Error(w, "Confirmation code has expired", http.StatusGone)
+		return
+	}
+
 	// Check validation code
 	confirmCode := r.PathParam("confirm_code")
 	if confirmCode != event.ConfirmCode(es.Secret) {
@@ -176,45 +355,187 @@ func (es *EventService) ConfirmEvent(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 
+	es.sendLoginLink(r, event, "Circuleo - Je participe ! - C'est parti !", "../templates/confirmed.html")
+}
+
+// LoginWithLink returns a JWT token for the event admin, or for an organizer given by its email
+// The code of the link sent by email is posted by the front-end once the user confirms,
+// so that a link opened by a mail scanner is not consumed (usable once)
+func (es *EventService) LoginWithLink(w rest.ResponseWriter, r *rest.Request) {
+	if !hasPermission(r, PermissionPublic) {
+		rest.Error(w, "Access forbidden", http.StatusForbidden)
+		return
+	}
+
+	eventCode := getEventCodeFromRequest(r)
+
+	link := &struct {
+		Code  string `json:"code"`
+		Email string `json:"email"`
+	}{}
+	if err := r.DecodeJsonPayload(link); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	organizerEmail := link.Email
+	_, err := es.UpdateEvent(eventCode, func(event *entities.Event) error {
+		if !event.EmailConfirmed {
+			return &requestError{"Invalid code", http.StatusNotFound}
+		}
+
+		valid := false
+		if organizerEmail == "" {
+			valid = event.ConsumeLoginCode(link.Code, es.Secret, time.Now())
+		} else if organizer := event.GetOrganizer(organizerEmail); organizer != nil {
+			valid = organizer.ConsumeLoginCode(eventCode, link.Code, es.Secret, time.Now())
+		}
+
+		if !valid {
+			return &requestError{"Invalid or expired login link", http.StatusUnauthorized}
+		}
+		return nil
+	})
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	userId := GetEventAdminLogin(eventCode)
+	if organizerEmail != "" {
+		userId = GetOrganizerLogin(eventCode, organizerEmail)
+	}
+
+	token, err := NewLoginLinkToken(es, userId)
+	if err != nil {
+		panic(err)
+	}
+	w.WriteJson(&SecurityToken{Token: token})
+}
+
+// ChangeEventPassword sets the password of the logged in organizer, or the event admin password
+// The current password is required, unless the organizer has none or has logged in with a link sent by email
+func (es *EventService) ChangeEventPassword(w rest.ResponseWriter, r *rest.Request) {
+	eventCode := getEventCodeFromRequest(r)
+	event := es.GetEvent(eventCode)
+
+	if event == nil {
+		rest.Error(w, "Invalid code", http.StatusNotFound)
+		return
+	}
+
+	if !hasPermission(r, PermissionAccount) {
+		rest.Error(w, "Access forbidden", http.StatusForbidden)
+		return
+	}
+
+	passwords := &struct {
+		Password    string `json:"password"`
+		NewPassword string `json:"newpassword"`
+	}{}
+	if err := r.DecodeJsonPayload(passwords); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(passwords.NewPassword) < MinPasswordLength {
+		rest.Error(w, "Password must have at least "+strconv.Itoa(MinPasswordLength)+" characters", http.StatusBadRequest)
+		return
+	}
+
+	user := r.Env["REMOTE_USER"].(string)
+	checkCurrent := func(hash string) error {
+		if hash != "" && !isLoginLinkSession(r) && !CheckPassword(hash, passwords.Password) {
+			return &requestError{"Invalid current password", http.StatusForbidden}
+		}
+		return nil
+	}
+
+	_, err := es.UpdateEvent(eventCode, func(event *entities.Event) error {
+		if !strings.HasPrefix(user, eventCode+OrganizerLoginSeparator) {
+			if err := checkCurrent(event.AdminPassword); err != nil {
+				return err
+			}
+			event.AdminPassword = HashPassword(passwords.NewPassword)
+			return nil
+		}
+
+		organizer := event.GetOrganizer(strings.TrimPrefix(user, eventCode+OrganizerLoginSeparator))
+		if organizer == nil {
+			return &requestError{"Access forbidden", http.StatusForbidden}
+		}
+		if err := checkCurrent(organizer.PasswordHash); err != nil {
+			return err
+		}
+		organizer.PasswordHash = HashPassword(passwords.NewPassword)
+		return nil
+	})
+
+	if err != nil {
+		writeError(w, err)
+	}
+}
+
+// ResetEventPassword replaces the event admin password by an unknown one and sends a login link to the organizer (superadmin only)
+func (es *EventService) ResetEventPassword(w rest.ResponseWriter, r *rest.Request) {
+	if !hasPermission(r, PermissionSuperAdmin) {
+		rest.Error(w, "Access forbidden", http.StatusForbidden)
+		return
+	}
+
+	event, err := es.UpdateEvent(getEventCodeFromRequest(r), func(event *entities.Event) error {
+		if !event.EmailConfirmed {
+			return &requestError{"Event not confirmed yet", http.StatusBadRequest}
+		}
+		event.AdminPassword = HashPassword(NewPassword(12))
+		return nil
+	})
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	es.sendLoginLink(r, event, "Circuleo - Je participe ! - Mot de passe réinitialisé", "../templates/passwordreset.html")
+}
+
+// sendLoginLink sends a login link for the event admin to the organizer
+func (es *EventService) sendLoginLink(r *rest.Request, event *entities.Event, subject string, template string) {
 	templateData := struct {
-		URL   string
-		Login string
-		Pass  string
+		URL      string
+		Login    string
+		LoginURL string
+		Code     string
 	}{
-		URL:   r.BaseUrl().String() + "/" + event.Code,
-		Login: GetEventAdminLogin(eventCode),
-		Pass:  event.AdminPassword,
+		URL:      r.BaseUrl().String() + "/" + event.Code,
+		Login:    GetEventAdminLogin(event.Code),
+		LoginURL: r.BaseUrl().String() + "/" + event.Code + "/login/" + event.LoginCode(es.Secret, time.Now().Add(es.LoginLinkExpiry)),
+		Code:     event.Code,
 	}
-	email := email.NewEmail(event.UserEmail, "Circuleo - Je participe ! - C'est parti !", "")
-	email.AddBodyUsingTemplate("../templates/confirmed.html", templateData)
+	email := email.NewEmail(event.UserEmail, subject, "")
+	email.AddBodyUsingTemplate(template, templateData)
 	es.EmailRelay.Send(email)
 }
 
 // SendEventInformationByMail sends an email to the event admin with the event informations
+// A confirmed event gets a login link, a pending event gets its confirmation link again
 func (es *EventService) SendEventInformationByMail(w rest.ResponseWriter, r *rest.Request) {
+	if !hasPermission(r, PermissionPublic) {
+		rest.Error(w, "Access forbidden", http.StatusForbidden)
+		return
+	}
+
 	eventCode := getEventCodeFromRequest(r)
 	event := es.GetEvent(eventCode)
 
-	if event == nil {
+	if event == nil || event.IsExpired(es.PendingExpiry) {
 		rest.Error(w, "Invalid code", http.StatusNotFound)
 		return
 	}
 
 	if event.EmailConfirmed {
-		templateData := struct {
-			URL   string
-			Login string
-			Pass  string
-			Code  string
-		}{
-			URL:   r.BaseUrl().String() + "/" + event.Code,
-			Login: GetEventAdminLogin(eventCode),
-			Pass:  event.AdminPassword,
-			Code:  event.Code,
-		}
-		email := email.NewEmail(event.UserEmail, "Circuleo - Je participe ! - Rappel de vos informations", "")
-		email.AddBodyUsingTemplate("../templates/lostaccount.html", templateData)
-		es.EmailRelay.Send(email)
+		es.sendLoginLink(r, event, "Circuleo - Je participe ! - Rappel de vos informations", "../templates/lostaccount.html")
 	} else {
 		templateData := struct {
 			URL string
@@ -231,17 +552,93 @@ func (es *EventService) SendEventInformationByMail(w rest.ResponseWriter, r *res
 func (es *EventService) ConfirmAndSaveEvent(event *entities.Event) error {
 	// Save updated event
 	event.EmailConfirmed = true
-	event.AdminPassword = NewPassword(8)
+	event.Password = NewPassword(8)
+	event.AdminPassword = HashPassword(event.Password)
 	es.SaveEvent(event)
 
 	// Init activities collection for this event
-	return es.RepositoryService.CreateCollectionIfNotExists(GetActivityBucketName(event.Code))
+	return es.Store.CreateCollectionIfNotExists(GetActivityBucketName(event.Code))
+}
+
+// HashPasswords hashes the admin passwords saved in clear text by a previous version and returns the number of updated events
+func (es *EventService) HashPasswords() (int, error) {
+	count := 0
+	err := es.Store.UpdateDocuments(EventsBucketName, func(identifier string) interface{} {
+		return &entities.Event{}
+	}, func(identifier string, document interface{}) (bool, error) {
+		event := document.(*entities.Event)
+		if !event.EmailConfirmed || event.AdminPassword == "" || IsPasswordHashed(event.AdminPassword) {
+			return false, nil
+		}
+		event.AdminPassword = HashPassword(event.AdminPassword)
+		count++
+		return true, nil
+	})
+	return count, err
+}
+
+// RemoveExpiredEvents removes the pending events which have not been confirmed in time and returns their codes
+func (es *EventService) RemoveExpiredEvents() ([]string, error) {
+	removed := make([]string, 0)
+	if es.PendingExpiry <= 0 {
+		return removed, nil
+	}
+
+	confirmed := false
+	events, err := es.ListEvents(&EventFilter{Confirmed: &confirmed})
+	if err != nil {
+		return nil, err
+	}
+
+	// The event may have been confirmed since it was listed, it is checked again before its removal
+	for _, event := range events {
+		if !event.IsExpired(es.PendingExpiry) {
+			continue
+		}
+		current := &entities.Event{}
+		deleted, err := es.Store.DeleteDocumentIf(EventsBucketName, event.Code, current, func() bool {
+			return current.Code != "" && current.IsExpired(es.PendingExpiry)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if deleted {
+			removed = append(removed, event.Code)
+		}
+	}
+	return removed, nil
+}
+
+// RemoveEvent records the tombstone, then deletes the activities and the event
+// The tombstone is written first so that a code is never reused even if the removal is interrupted
+func (es *EventService) RemoveEvent(tombstone *entities.Tombstone) error {
+	if err := es.Store.CreateCollectionIfNotExists(TombstonesBucketName); err != nil {
+		return err
+	}
+	if err := es.Store.CommitDocument(TombstonesBucketName, tombstone.Code, tombstone); err != nil {
+		return err
+	}
+	if err := es.Store.DeleteCollection(GetActivityBucketName(tombstone.Code)); err != nil {
+		return err
+	}
+	return es.Store.DeleteDocument(EventsBucketName, tombstone.Code)
+}
+
+// GetTombstone gets the tombstone of a deleted event code
+func (es *EventService) GetTombstone(eventCode string) *entities.Tombstone {
+	tombstone := &entities.Tombstone{}
+	es.Store.GetDocument(TombstonesBucketName, eventCode, tombstone)
+	if tombstone.Code == "" {
+		return nil
+	}
+
+	return tombstone
 }
 
 // GetEvent gets an event from database
 func (es *EventService) GetEvent(eventCode string) *entities.Event {
 	event := &entities.Event{}
-	es.RepositoryService.GetDocument(EventsBucketName, eventCode, event)
+	es.Store.GetDocument(EventsBucketName, eventCode, event)
 	if event.Code == "" {
 		return nil
 	}
@@ -249,9 +646,55 @@ func (es *EventService) GetEvent(eventCode string) *entities.Event {
 	return event
 }
 
+// ListEvents returns the events matching the filter, sorted by code
+func (es *EventService) ListEvents(filter *EventFilter) ([]*entities.Event, error) {
+	codes, err := es.Store.GetIdentifiers(EventsBucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	email := strings.ToLower(filter.Email)
+	events := make([]*entities.Event, 0)
+	for _, code := range codes {
+		event := &entities.Event{}
+		if err := es.Store.GetDocument(EventsBucketName, code, event); err != nil {
+			return nil, err
+		}
+
+		if filter.Confirmed != nil && event.EmailConfirmed != *filter.Confirmed {
+			continue
+		}
+		if !filter.CreatedAfter.IsZero() && event.CreatedAt.Before(filter.CreatedAfter) {
+			continue
+		}
+		if !filter.CreatedBefore.IsZero() && !event.CreatedAt.Before(filter.CreatedBefore) {
+			continue
+		}
+		if email != "" && !strings.Contains(strings.ToLower(event.UserEmail), email) {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
 // SaveEvent saves an event to the database
 func (es *EventService) SaveEvent(event *entities.Event) error {
-	return es.RepositoryService.CommitDocument(EventsBucketName, event.Code, event)
+	event.Revision++
+	return es.Store.CommitDocument(EventsBucketName, event.Code, event)
+}
+
+// UpdateEvent loads an existing event, applies update and saves it atomically
+// Nothing is saved if update returns an error, the revision is only changed with the config
+func (es *EventService) UpdateEvent(eventCode string, update func(event *entities.Event) error) (*entities.Event, error) {
+	event := &entities.Event{}
+	err := es.Store.UpdateDocument(EventsBucketName, eventCode, event, func() error {
+		if event.Code == "" {
+			return &requestError{"Invalid code", http.StatusNotFound}
+		}
+		return update(event)
+	})
+	return event, err
 }
 
 // getEventCodeFromRequest is a convenient method to get an event code from request
@@ -259,3 +702,26 @@ func getEventCodeFromRequest(r *rest.Request) string {
 	extractor, _ := regexp.Compile("[-A-Za-z0-9]{2,50}")
 	return extractor.FindString(r.PathParam("event"))
 }
+
+// parseDateParam parses a RFC3339 date or a day (YYYY-MM-DD), an empty value is the zero time
+// A day is parsed as the beginning of the next day when dayEnd is true
+func parseDateParam(value string, dayEnd bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if date, err := time.Parse("2006-01-02", value); err == nil {
+		if dayEnd {
+			date = date.AddDate(0, 0, 1)
+		}
+		return date, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// parseIntParam parses an integer, an empty value is the default value
+func parseIntParam(value string, defaultValue int) (int, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(value)
+}
@@ -6,10 +6,13 @@ import (
 	"github.com/julienbayle/jeparticipe/app/test"
 	"github.com/julienbayle/jeparticipe/email"
 	"github.com/julienbayle/jeparticipe/entities"
+	"github.com/julienbayle/jeparticipe/services"
 	"github.com/stretchr/testify/assert"
 
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 )
 
 type EventState struct {
@@ -127,7 +130,7 @@ func TestSetEventConfig(t *testing.T) {
 	eventNotConfirmed, _ := entities.NewPendingConfirmationEvent("notconfirmed", "ip", "test@test.com")
 	jeparticipe.EventService.SaveEvent(eventNotConfirmed)
 
-	token := apptest.GetAdminTokenForEvent(t, &handler, eventNotConfirmed)
+	token := apptest.GetSuperAdminToken(t, &handler, jeparticipe)
 	rq := apptest.MakeAdminRequest("PUT", "/event/notconfirmed/config", nil, token)
 	recorded = test.RunRequest(t, handler, rq)
 	recorded.CodeIs(400)
@@ -163,6 +166,43 @@ func TestSetEventConfig(t *testing.T) {
 	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "/event/testevent/config", nil))
 	recorded.CodeIs(200)
 	recorded.BodyIs(`{"Child":{"Child":null,"Text":"toto2"},"Text":"toto"}`)
+	recorded.HeaderIs("ETag", `"2"`)
+
+	// ------------------------------------
+	// Event exists and is confirmed / Send a config with a stale revision
+	// ------------------------------------
+
+	rq = apptest.MakeAdminRequest("PUT", "/event/testevent/config", data, token)
+	rq.Header.Set("If-Match", `"1"`)
+	recorded = test.RunRequest(t, handler, rq)
+	recorded.CodeIs(412)
+	recorded.BodyIs(`{"Error":"Event has been modified"}`)
+
+	// ------------------------------------
+	// Event exists and is confirmed / Send a config with the current revision
+	// ------------------------------------
+
+	rq = apptest.MakeAdminRequest("PUT", "/event/testevent/config", data, token)
+	rq.Header.Set("If-Match", `"2"`)
+	recorded = test.RunRequest(t, handler, rq)
+	recorded.CodeIs(200)
+	recorded.HeaderIs("ETag", `"3"`)
+
+	// ------------------------------------
+	// Event exists and is confirmed / Other changes of the event keep the config revision
+	// ------------------------------------
+
+	_, err := jeparticipe.EventService.UpdateEvent(event.Code, func(event *entities.Event) error {
+		event.LoginNonce = "changed"
+		return nil
+	})
+	assert.NoError(t, err)
+
+	rq = apptest.MakeAdminRequest("PUT", "/event/testevent/config", data, token)
+	rq.Header.Set("If-Match", `"3"`)
+	recorded = test.RunRequest(t, handler, rq)
+	recorded.CodeIs(200)
+	recorded.HeaderIs("ETag", `"4"`)
 
 	// ------------------------------------
 	// Event exists and is confirmed / Send a bad JSON as config
@@ -303,9 +343,8 @@ func TestConfirmEvent(t *testing.T) {
 
 	jeparticipe.EventService.EmailRelay = &email.EmailRelay{
 		Send: func(email *email.Email) error {
-			updatedEvent := jeparticipe.EventService.GetEvent(event.Code)
-			if !strings.Contains(email.Body, updatedEvent.AdminPassword) {
-				t.Errorf("Email body is suspect : %s, password %s", email.Body, updatedEvent.AdminPassword)
+			if loginCodeFromEmail(email.Body) == "" || strings.Contains(email.Body, "Mot de passe") {
+				t.Errorf("Email body is suspect : %s", email.Body)
 			}
 			if email.To != "test@test.com" {
 				t.Errorf("Bad recipient")
@@ -387,9 +426,12 @@ func TestSendEventInformationByMail(t *testing.T) {
 
 	jeparticipe.EventService.EmailRelay = &email.EmailRelay{
 		Send: func(email *email.Email) error {
-			if !strings.Contains(email.Body, eventConfirmed.AdminPassword) {
+			if loginCodeFromEmail(email.Body) == "" {
 				t.Errorf("Email body is suspect : %s", email.Body)
 			}
+			if strings.Contains(email.Body, eventConfirmed.Password) {
+				t.Errorf("Password should not be sent : %s", email.Body)
+			}
 			if email.To != "test@test.com" {
 				t.Errorf("Bad recipient")
 			}
@@ -401,3 +443,373 @@ func TestSendEventInformationByMail(t *testing.T) {
 	recorded.CodeIs(200)
 	recorded.BodyIs("")
 }
+
+func TestGetEvents(t *testing.T) {
+	jeparticipe, handler, event := apptest.CreateATestApp()
+	defer apptest.DeleteTestApp(jeparticipe)
+
+	pending, _ := entities.NewPendingConfirmationEvent("pending", "ip", "Someone@School.org")
+	pending.CreatedAt = time.Date(2016, 1, 15, 10, 0, 0, 0, time.UTC)
+	jeparticipe.EventService.SaveEvent(pending)
+
+	old, _ := entities.NewPendingConfirmationEvent("old", "ip", "other@school.org")
+	old.CreatedAt = time.Date(2015, 6, 1, 10, 0, 0, 0, time.UTC)
+	jeparticipe.EventService.ConfirmAndSaveEvent(old)
+
+	// ------------------------------------
+	// Permissions
+	// ------------------------------------
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "/event", nil))
+	recorded.CodeIs(403)
+
+	token := apptest.GetAdminTokenForEvent(t, &handler, event)
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("GET", "/event", nil, token))
+	recorded.CodeIs(403)
+
+	token = apptest.GetSuperAdminToken(t, &handler, jeparticipe)
+	getEvents := func(query string) *services.EventList {
+		recorded := test.RunRequest(t, handler, apptest.MakeAdminRequest("GET", "/event"+query, nil, token))
+		recorded.CodeIs(200)
+		list := &services.EventList{}
+		assert.NoError(t, recorded.DecodeJsonPayload(list))
+		return list
+	}
+
+	// ------------------------------------
+	// All events, sorted by code, without password
+	// ------------------------------------
+
+	list := getEvents("")
+	assert.Equal(t, 3, list.Total)
+	assert.Equal(t, services.DefaultEventListLimit, list.Limit)
+	assert.Len(t, list.Events, 3)
+	assert.Equal(t, "old", list.Events[0].Code)
+	assert.Equal(t, "pending", list.Events[1].Code)
+	assert.Equal(t, "testevent", list.Events[2].Code)
+	for _, e := range list.Events {
+		assert.Empty(t, e.AdminPassword)
+	}
+	assert.NotEmpty(t, jeparticipe.EventService.GetEvent("old").AdminPassword)
+
+	// ------------------------------------
+	// Pagination
+	// ------------------------------------
+
+	list = getEvents("?offset=1&limit=1")
+	assert.Equal(t, 3, list.Total)
+	assert.Len(t, list.Events, 1)
+	assert.Equal(t, "pending", list.Events[0].Code)
+
+	list = getEvents("?offset=5")
+	assert.Equal(t, 3, list.Total)
+	assert.Len(t, list.Events, 0)
+
+	// ------------------------------------
+	// Filters
+	// ------------------------------------
+
+	list = getEvents("?confirmed=false")
+	assert.Len(t, list.Events, 1)
+	assert.Equal(t, "pending", list.Events[0].Code)
+
+	list = getEvents("?confirmed=true")
+	assert.Equal(t, 2, list.Total)
+
+	list = getEvents("?from=2016-01-01&to=2016-01-15")
+	assert.Len(t, list.Events, 1)
+	assert.Equal(t, "pending", list.Events[0].Code)
+
+	list = getEvents("?to=2016-01-15T10:00:00Z")
+	assert.Len(t, list.Events, 1)
+	assert.Equal(t, "old", list.Events[0].Code)
+
+	list = getEvents("?email=someone@school")
+	assert.Len(t, list.Events, 1)
+	assert.Equal(t, "pending", list.Events[0].Code)
+
+	list = getEvents("?email=school.org&confirmed=true")
+	assert.Len(t, list.Events, 1)
+	assert.Equal(t, "old", list.Events[0].Code)
+
+	// ------------------------------------
+	// Invalid parameters
+	// ------------------------------------
+
+	for _, query := range []string{"?confirmed=maybe", "?from=yesterday", "?to=2016-13-01", "?offset=-1", "?limit=0", "?limit=100000"} {
+		recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("GET", "/event"+query, nil, token))
+		recorded.CodeIs(400)
+	}
+}
+
+func TestDeleteEvent(t *testing.T) {
+	jeparticipe, handler, event := apptest.CreateATestApp()
+	defer apptest.DeleteTestApp(jeparticipe)
+
+	activity := jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code)
+	activity.AddParticipant("public", "private", "ip")
+	assert.NoError(t, jeparticipe.ActivityService.SaveActivity(activity, event.Code))
+
+	otherEvent, _ := entities.NewPendingConfirmationEvent("otherevent", "ip", "test@test.com")
+	jeparticipe.EventService.ConfirmAndSaveEvent(otherEvent)
+
+	// ------------------------------------
+	// Permissions
+	// ------------------------------------
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("DELETE", "/event/invalidcode", nil))
+	recorded.CodeIs(404)
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("DELETE", "/event/testevent", nil))
+	recorded.CodeIs(403)
+
+	otherToken := apptest.GetAdminTokenForEvent(t, &handler, otherEvent)
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("DELETE", "/event/testevent", nil, otherToken))
+	recorded.CodeIs(403)
+
+	// ------------------------------------
+	// Event admin deletes its event and its activities
+	// ------------------------------------
+
+	token := apptest.GetAdminTokenForEvent(t, &handler, event)
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("DELETE", "/event/testevent", nil, token))
+	recorded.CodeIs(200)
+
+	assert.Nil(t, jeparticipe.EventService.GetEvent(event.Code))
+	collections, err := jeparticipe.Store.GetCollections(services.GetActivityBucketName(""))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{services.GetActivityBucketName("otherevent")}, collections)
+
+	tombstone := jeparticipe.EventService.GetTombstone(event.Code)
+	assert.NotNil(t, tombstone)
+	assert.Equal(t, "testevent-admin", tombstone.DeletedBy)
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "/event/testevent/status", nil))
+	recorded.CodeIs(404)
+
+	// ------------------------------------
+	// Code can not be reused during the cooling-off period
+	// ------------------------------------
+
+	jeparticipe.EventService.EmailRelay.Send = func(email *email.Email) error { return nil }
+	newEvent := map[string]string{"Code": "testevent", "UserEmail": "new@test.com"}
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "/event", newEvent))
+	recorded.CodeIs(403)
+
+	tombstone.DeletedAt = time.Now().Add(-services.DefaultCoolingOff)
+	assert.NoError(t, jeparticipe.Store.CommitDocument(services.TombstonesBucketName, tombstone.Code, tombstone))
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "/event", newEvent))
+	recorded.CodeIs(200)
+	assert.Equal(t, "new@test.com", jeparticipe.EventService.GetEvent("testevent").UserEmail)
+	assert.Nil(t, jeparticipe.EventService.GetTombstone("testevent"))
+
+	// ------------------------------------
+	// Superadmin deletes any event
+	// ------------------------------------
+
+	token = apptest.GetSuperAdminToken(t, &handler, jeparticipe)
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("DELETE", "/event/otherevent", nil, token))
+	recorded.CodeIs(200)
+	assert.Nil(t, jeparticipe.EventService.GetEvent("otherevent"))
+	assert.Equal(t, "superadmin", jeparticipe.EventService.GetTombstone("otherevent").DeletedBy)
+}
+
+func TestPendingEventExpiry(t *testing.T) {
+	jeparticipe, handler, _ := apptest.CreateATestApp()
+	defer apptest.DeleteTestApp(jeparticipe)
+
+	jeparticipe.EventService.EmailRelay = &email.EmailRelay{
+		Send: func(email *email.Email) error {
+			return nil
+		},
+	}
+
+	expired, _ := entities.NewPendingConfirmationEvent("expired", "ip", "test@test.com")
+	expired.CreatedAt = time.Now().Add(-services.DefaultPendingExpiry - time.Minute)
+	jeparticipe.EventService.SaveEvent(expired)
+
+	pending, _ := entities.NewPendingConfirmationEvent("pending", "ip", "test@test.com")
+	jeparticipe.EventService.SaveEvent(pending)
+
+	// ------------------------------------
+	// Confirmation code is not valid anymore
+	// ------------------------------------
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "/event/expired/confirm/"+expired.ConfirmCode(jeparticipe.Secret), nil))
+	recorded.CodeIs(410)
+	assert.False(t, jeparticipe.EventService.GetEvent("expired").EmailConfirmed)
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "/event/expired/lostaccount", nil))
+	recorded.CodeIs(404)
+
+	// ------------------------------------
+	// Code can be used by a new event
+	// ------------------------------------
+
+	data := &map[string]string{"code": "expired", "userEmail": "new@test.com"}
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "/event", data))
+	recorded.CodeIs(200)
+	assert.Equal(t, "new@test.com", jeparticipe.EventService.GetEvent("expired").UserEmail)
+
+	expired = jeparticipe.EventService.GetEvent("expired")
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "/event/expired/confirm/"+expired.ConfirmCode(jeparticipe.Secret), nil))
+	recorded.CodeIs(200)
+
+	// ------------------------------------
+	// Sweeper removes expired events only
+	// ------------------------------------
+
+	old, _ := entities.NewPendingConfirmationEvent("old", "ip", "test@test.com")
+	old.CreatedAt = time.Now().Add(-72 * time.Hour)
+	jeparticipe.EventService.SaveEvent(old)
+
+	assert.NoError(t, jeparticipe.StartExpiry(time.Hour*24, time.Hour))
+	assert.Nil(t, jeparticipe.EventService.GetEvent("old"))
+	assert.NotNil(t, jeparticipe.EventService.GetEvent("pending"))
+	assert.NotNil(t, jeparticipe.EventService.GetEvent("expired"))
+	assert.NotNil(t, jeparticipe.EventService.GetEvent("testevent"))
+
+	removed, err := jeparticipe.EventService.RemoveExpiredEvents()
+	assert.NoError(t, err)
+	assert.Len(t, removed, 0)
+}
+
+func TestEventPassword(t *testing.T) {
+	jeparticipe, handler, event := apptest.CreateATestApp()
+	defer apptest.DeleteTestApp(jeparticipe)
+
+	var sent *email.Email
+	jeparticipe.EventService.EmailRelay = &email.EmailRelay{
+		Send: func(email *email.Email) error {
+			sent = email
+			return nil
+		},
+	}
+
+	login := func(password string) int {
+		loginCreds := map[string]string{"username": "testevent-admin", "password": password}
+		return test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "/login", loginCreds)).Recorder.Code
+	}
+
+	// ------------------------------------
+	// Only the hash is saved
+	// ------------------------------------
+
+	saved := jeparticipe.EventService.GetEvent(event.Code)
+	assert.NotEqual(t, event.Password, saved.AdminPassword)
+	assert.True(t, services.CheckPassword(saved.AdminPassword, event.Password))
+
+	// ------------------------------------
+	// Change password
+	// ------------------------------------
+
+	token := apptest.GetAdminTokenForEvent(t, &handler, event)
+	passwords := map[string]string{"password": event.Password, "newpassword": "newpassword"}
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("PUT", "/event/testevent/password", passwords))
+	recorded.CodeIs(403)
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/password", map[string]string{"password": event.Password, "newpassword": "short"}, token))
+	recorded.CodeIs(400)
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/password", map[string]string{"newpassword": "newpassword"}, token))
+	recorded.CodeIs(403)
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/password", map[string]string{"password": "badpassword", "newpassword": "newpassword"}, token))
+	recorded.CodeIs(403)
+	assert.Equal(t, 200, login(event.Password))
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/password", passwords, token))
+	recorded.CodeIs(200)
+	assert.Equal(t, 401, login(event.Password))
+	assert.Equal(t, 200, login("newpassword"))
+
+	// ------------------------------------
+	// Reset by the superadmin, the organizer gets a login link
+	// ------------------------------------
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("POST", "/event/testevent/password/reset", nil, token))
+	recorded.CodeIs(403)
+	assert.Nil(t, sent)
+
+	superToken := apptest.GetSuperAdminToken(t, &handler, jeparticipe)
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("POST", "/event/donotexists/password/reset", nil, superToken))
+	recorded.CodeIs(404)
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("POST", "/event/testevent/password/reset", nil, superToken))
+	recorded.CodeIs(200)
+	assert.Equal(t, "test@test.com", sent.To)
+	loginCode := loginCodeFromEmail(sent.Body)
+	assert.NotEmpty(t, loginCode)
+	assert.Equal(t, 401, login("newpassword"))
+
+	// ------------------------------------
+	// The current password is not required with a login link
+	// ------------------------------------
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "/event/testevent/login", map[string]string{"code": loginCode}))
+	recorded.CodeIs(200)
+	linkToken := services.SecurityToken{}
+	assert.NoError(t, recorded.DecodeJsonPayload(&linkToken))
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/password", map[string]string{"newpassword": "linkpassword"}, linkToken.Token))
+	recorded.CodeIs(200)
+	assert.Equal(t, 200, login("linkpassword"))
+}
+
+func TestLoginWithLink(t *testing.T) {
+	jeparticipe, handler, event := apptest.CreateATestApp()
+	defer apptest.DeleteTestApp(jeparticipe)
+
+	var sent *email.Email
+	jeparticipe.EventService.EmailRelay = &email.EmailRelay{
+		Send: func(email *email.Email) error {
+			sent = email
+			return nil
+		},
+	}
+
+	test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "/event/testevent/lostaccount", nil)).CodeIs(200)
+	loginCode := loginCodeFromEmail(sent.Body)
+	assert.NotEmpty(t, loginCode)
+
+	// ------------------------------------
+	// Invalid links
+	// ------------------------------------
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "/event/donotexists/login", map[string]string{"code": loginCode}))
+	recorded.CodeIs(404)
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "/event/testevent/login", map[string]string{"code": "badcode"}))
+	recorded.CodeIs(401)
+
+	expired := event.LoginCode(jeparticipe.EventService.Secret, time.Now().Add(-time.Minute))
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "/event/testevent/login", map[string]string{"code": expired}))
+	recorded.CodeIs(401)
+
+	// ------------------------------------
+	// The link gives an admin token, only once
+	// ------------------------------------
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "/event/testevent/login", map[string]string{"code": loginCode}))
+	recorded.CodeIs(200)
+
+	token := services.SecurityToken{}
+	assert.NoError(t, recorded.DecodeJsonPayload(&token))
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/bar/state/close", nil, token.Token))
+	recorded.CodeIs(200)
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "/event/testevent/login", map[string]string{"code": loginCode}))
+	recorded.CodeIs(401)
+}
+
+// loginCodeFromEmail extracts the login code from a login link email
+func loginCodeFromEmail(body string) string {
+	extractor, _ := regexp.Compile("/login/([-0-9a-f]+)\"")
+	matches := extractor.FindStringSubmatch(body)
+	if matches == nil {
+		return ""
+	}
+	return matches[1]
+}
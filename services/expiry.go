@@ -0,0 +1,40 @@
+package services
+
+import (
+	"log"
+	"time"
+)
+
+// ExpiryService periodically removes the pending events which have not been confirmed in time
+type ExpiryService struct {
+	EventService *EventService
+
+	// Delay between two sweeps
+	Interval time.Duration
+
+	stop func()
+}
+
+// Start removes expired events and then sweeps again at every interval
+func (es *ExpiryService) Start() error {
+	if _, err := es.EventService.RemoveExpiredEvents(); err != nil {
+		return err
+	}
+
+	es.stop = runEvery(es.Interval, func(now time.Time) {
+		if removed, err := es.EventService.RemoveExpiredEvents(); err != nil {
+			log.Printf("Expired events removal failed : %s", err)
+		} else if len(removed) > 0 {
+			log.Printf("%d expired events removed", len(removed))
+		}
+	})
+	return nil
+}
+
+// Stop waits for the current sweep and stops the scheduler
+func (es *ExpiryService) Stop() {
+	if es.stop != nil {
+		es.stop()
+		es.stop = nil
+	}
+}
@@ -0,0 +1,238 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemoryStore is a volatile Store, mainly used for tests
+// Documents are kept as JSON to behave exactly like the persistent stores
+type MemoryStore struct {
+	mutex       sync.RWMutex
+	collections map[string]map[string][]byte
+}
+
+// NewMemoryStore creates a new empty memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		collections: make(map[string]map[string][]byte),
+	}
+}
+
+// ShutDown drops all the data
+func (ms *MemoryStore) ShutDown() {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.collections = make(map[string]map[string][]byte)
+}
+
+// CreateCollectionIfNotExists creates a new document collection
+func (ms *MemoryStore) CreateCollectionIfNotExists(collection string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if _, ok := ms.collections[collection]; !ok {
+		ms.collections[collection] = make(map[string][]byte)
+	}
+	return nil
+}
+
+// GetCollections returns the names of the collections starting with prefix
+func (ms *MemoryStore) GetCollections(prefix string) ([]string, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	collections := make([]string, 0)
+	for name := range ms.collections {
+		if strings.HasPrefix(name, prefix) {
+			collections = append(collections, name)
+		}
+	}
+	sort.Strings(collections)
+	return collections, nil
+}
+
+// GetIdentifiers returns the identifiers of the documents of a collection
+func (ms *MemoryStore) GetIdentifiers(collection string) ([]string, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	c, ok := ms.collections[collection]
+	if !ok {
+		return nil, errors.New("Collection " + collection + " does not exist")
+	}
+	identifiers := make([]string, 0, len(c))
+	for identifier := range c {
+		identifiers = append(identifiers, identifier)
+	}
+	sort.Strings(identifiers)
+	return identifiers, nil
+}
+
+// GetDocument gets a document from a collection
+func (ms *MemoryStore) GetDocument(collection string, identifier string, document interface{}) error {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	c, ok := ms.collections[collection]
+	if !ok {
+		return errors.New("Collection " + collection + " does not exist")
+	}
+	if v, ok := c[identifier]; ok {
+		return json.Unmarshal(v, document)
+	}
+	return nil
+}
+
+// CommitDocument commits a document to the store (create / update)
+func (ms *MemoryStore) CommitDocument(collection string, identifier string, document interface{}) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	c, ok := ms.collections[collection]
+	if !ok {
+		return errors.New("Collection " + collection + " does not exist")
+	}
+	data, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+	c[identifier] = data
+	return nil
+}
+
+// UpdateDocument loads, updates and commits a document while holding the store lock
+func (ms *MemoryStore) UpdateDocument(collection string, identifier string, document interface{}, update func() error) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	c, ok := ms.collections[collection]
+	if !ok {
+		return errors.New("Collection " + collection + " does not exist")
+	}
+	if v, ok := c[identifier]; ok {
+		if err := json.Unmarshal(v, document); err != nil {
+			return err
+		}
+	}
+	if err := update(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+	c[identifier] = data
+	return nil
+}
+
+// UpdateDocumentGroup loads, updates and commits several documents while holding the store lock
+func (ms *MemoryStore) UpdateDocumentGroup(collection string, identifiers []string, documents []interface{}, update func() error) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	c, ok := ms.collections[collection]
+	if !ok {
+		return errors.New("Collection " + collection + " does not exist")
+	}
+	for i, identifier := range identifiers {
+		if v, ok := c[identifier]; ok {
+			if err := json.Unmarshal(v, documents[i]); err != nil {
+				return err
+			}
+		}
+	}
+	if err := update(); err != nil {
+		return err
+	}
+
+	// Changes are applied only once every document has been serialized
+	updated := make([][]byte, len(identifiers))
+	for i := range identifiers {
+		data, err := json.Marshal(documents[i])
+		if err != nil {
+			return err
+		}
+		updated[i] = data
+	}
+	for i, identifier := range identifiers {
+		c[identifier] = updated[i]
+	}
+	return nil
+}
+
+// UpdateDocuments loads, updates and commits all the documents of a collection while holding the store lock
+func (ms *MemoryStore) UpdateDocuments(collection string, newDocument func(identifier string) interface{}, update func(identifier string, document interface{}) (bool, error)) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	c, ok := ms.collections[collection]
+	if !ok {
+		return errors.New("Collection " + collection + " does not exist")
+	}
+
+	identifiers := make([]string, 0, len(c))
+	for identifier := range c {
+		identifiers = append(identifiers, identifier)
+	}
+	sort.Strings(identifiers)
+
+	// Changes are applied only once every document has been updated
+	updated := make(map[string][]byte)
+	for _, identifier := range identifiers {
+		document := newDocument(identifier)
+		if err := json.Unmarshal(c[identifier], document); err != nil {
+			return err
+		}
+		changed, err := update(identifier, document)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			continue
+		}
+		if updated[identifier], err = json.Marshal(document); err != nil {
+			return err
+		}
+	}
+
+	for identifier, data := range updated {
+		c[identifier] = data
+	}
+	return nil
+}
+
+// DeleteDocument removes a document from a collection
+func (ms *MemoryStore) DeleteDocument(collection string, identifier string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	c, ok := ms.collections[collection]
+	if !ok {
+		return errors.New("Collection " + collection + " does not exist")
+	}
+	delete(c, identifier)
+	return nil
+}
+
+// DeleteDocumentIf loads a document and removes it if check returns true while holding the store lock
+func (ms *MemoryStore) DeleteDocumentIf(collection string, identifier string, document interface{}, check func() bool) (bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	c, ok := ms.collections[collection]
+	if !ok {
+		return false, errors.New("Collection " + collection + " does not exist")
+	}
+	if v, ok := c[identifier]; ok {
+		if err := json.Unmarshal(v, document); err != nil {
+			return false, err
+		}
+	}
+	if !check() {
+		return false, nil
+	}
+	delete(c, identifier)
+	return true, nil
+}
+
+// DeleteCollection removes a collection and all its documents
+func (ms *MemoryStore) DeleteCollection(collection string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	delete(ms.collections, collection)
+	return nil
+}
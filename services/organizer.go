@@ -0,0 +1,169 @@
+package services
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/julienbayle/jeparticipe/email"
+	"github.com/julienbayle/jeparticipe/entities"
+)
+
+// GetOrganizers returns the co-organizers of an event (event owners)
+func (es *EventService) GetOrganizers(w rest.ResponseWriter, r *rest.Request) {
+	event := es.GetEvent(getEventCodeFromRequest(r))
+
+	if event == nil {
+		rest.Error(w, "Invalid code", http.StatusNotFound)
+		return
+	}
+
+	if !hasPermission(r, PermissionManageEvent) {
+		rest.Error(w, "Access forbidden", http.StatusForbidden)
+		return
+	}
+
+	returnOrganizersAsJson(event, w)
+}
+
+// InviteOrganizer adds a co-organizer to an event and sends a login link to the organizer (event owners)
+// Inviting an existing organizer sends a new login link, its role is unchanged
+func (es *EventService) InviteOrganizer(w rest.ResponseWriter, r *rest.Request) {
+	eventCode := getEventCodeFromRequest(r)
+	if es.GetEvent(eventCode) == nil {
+		rest.Error(w, "Invalid code", http.StatusNotFound)
+		return
+	}
+
+	if !hasPermission(r, PermissionManageEvent) {
+		rest.Error(w, "Access forbidden", http.StatusForbidden)
+		return
+	}
+
+	invitation := &struct {
+		Email      string   `json:"email"`
+		Role       string   `json:"role"`
+		Activities []string `json:"activities"`
+	}{}
+	if err := r.DecodeJsonPayload(invitation); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var organizer *entities.Organizer
+	event, err := es.UpdateEvent(eventCode, func(event *entities.Event) error {
+		if !event.EmailConfirmed {
+			return &requestError{"Event not confirmed yet", http.StatusBadRequest}
+		}
+
+		if organizer = event.GetOrganizer(invitation.Email); organizer != nil {
+			return nil
+		}
+
+		var err error
+		if organizer, err = event.AddOrganizer(invitation.Email, r.Env["REMOTE_USER"].(string), invitation.Role, invitation.Activities); err != nil {
+			return &requestError{err.Error(), http.StatusBadRequest}
+		}
+		return nil
+	})
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	templateData := struct {
+		URL      string
+		Code     string
+		LoginURL string
+	}{
+		URL:      r.BaseUrl().String() + "/" + event.Code,
+		Code:     event.Code,
+		LoginURL: r.BaseUrl().String() + "/" + event.Code + "/login/" + organizer.LoginCode(event.Code, es.Secret, time.Now().Add(es.LoginLinkExpiry)) + "?email=" + url.QueryEscape(organizer.Email),
+	}
+	email := email.NewEmail(organizer.Email, "Circuleo - Je participe ! - Invitation", "")
+	email.AddBodyUsingTemplate("../templates/invitation.html", templateData)
+	es.EmailRelay.Send(email)
+
+	returnOrganizersAsJson(event, w)
+}
+
+// UpdateOrganizer changes the role of a co-organizer (event owners)
+func (es *EventService) UpdateOrganizer(w rest.ResponseWriter, r *rest.Request) {
+	eventCode := getEventCodeFromRequest(r)
+	if es.GetEvent(eventCode) == nil {
+		rest.Error(w, "Invalid code", http.StatusNotFound)
+		return
+	}
+
+	if !hasPermission(r, PermissionManageEvent) {
+		rest.Error(w, "Access forbidden", http.StatusForbidden)
+		return
+	}
+
+	role := &struct {
+		Role       string   `json:"role"`
+		Activities []string `json:"activities"`
+	}{}
+	if err := r.DecodeJsonPayload(role); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	event, err := es.UpdateEvent(eventCode, func(event *entities.Event) error {
+		organizer := event.GetOrganizer(r.PathParam("email"))
+		if organizer == nil {
+			return &requestError{"Organizer not found", http.StatusNotFound}
+		}
+		if err := organizer.SetRole(role.Role, role.Activities); err != nil {
+			return &requestError{err.Error(), http.StatusBadRequest}
+		}
+		return nil
+	})
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	returnOrganizersAsJson(event, w)
+}
+
+// RevokeOrganizer removes a co-organizer from an event, its tokens are not accepted anymore (event owners)
+func (es *EventService) RevokeOrganizer(w rest.ResponseWriter, r *rest.Request) {
+	eventCode := getEventCodeFromRequest(r)
+	if es.GetEvent(eventCode) == nil {
+		rest.Error(w, "Invalid code", http.StatusNotFound)
+		return
+	}
+
+	if !hasPermission(r, PermissionManageEvent) {
+		rest.Error(w, "Access forbidden", http.StatusForbidden)
+		return
+	}
+
+	event, err := es.UpdateEvent(eventCode, func(event *entities.Event) error {
+		if !event.RemoveOrganizer(r.PathParam("email")) {
+			return &requestError{"Organizer not found", http.StatusNotFound}
+		}
+		return nil
+	})
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	returnOrganizersAsJson(event, w)
+}
+
+// returnOrganizersAsJson sends back the organizers of an event without their secrets
+func returnOrganizersAsJson(event *entities.Event, w rest.ResponseWriter) {
+	event.RemoveSecrets()
+	organizers := event.Organizers
+	if organizers == nil {
+		organizers = make([]*entities.Organizer, 0)
+	}
+	w.WriteJson(organizers)
+}
@@ -0,0 +1,268 @@
+package services_test
+
+import (
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"github.com/julienbayle/jeparticipe/app/test"
+	"github.com/julienbayle/jeparticipe/email"
+	"github.com/julienbayle/jeparticipe/entities"
+	"github.com/julienbayle/jeparticipe/services"
+	"github.com/stretchr/testify/assert"
+
+	"net/url"
+	"regexp"
+	"testing"
+)
+
+func TestOrganizers(t *testing.T) {
+	jeparticipe, handler, event := apptest.CreateATestApp()
+	defer apptest.DeleteTestApp(jeparticipe)
+
+	var sent *email.Email
+	jeparticipe.EventService.EmailRelay = &email.EmailRelay{
+		Send: func(email *email.Email) error {
+			sent = email
+			return nil
+		},
+	}
+
+	token := apptest.GetAdminTokenForEvent(t, &handler, event)
+	invitation := map[string]string{"email": "Alice@School.org"}
+
+	// ------------------------------------
+	// Only admins manage organizers
+	// ------------------------------------
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "/event/testevent/organizers", invitation))
+	recorded.CodeIs(403)
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "/event/testevent/organizers", nil))
+	recorded.CodeIs(403)
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("POST", "/event/donotexists/organizers", invitation, token))
+	recorded.CodeIs(404)
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("POST", "/event/testevent/organizers", map[string]string{"email": "invalid"}, token))
+	recorded.CodeIs(400)
+
+	// ------------------------------------
+	// Invitation, the organizer logs in with the link and chooses a password
+	// ------------------------------------
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("POST", "/event/testevent/organizers", invitation, token))
+	recorded.CodeIs(200)
+	assert.Equal(t, "alice@school.org", sent.To)
+
+	organizers := []*entities.Organizer{}
+	assert.NoError(t, recorded.DecodeJsonPayload(&organizers))
+	assert.Len(t, organizers, 1)
+	assert.Equal(t, "alice@school.org", organizers[0].Email)
+	assert.Equal(t, "testevent-admin", organizers[0].InvitedBy)
+
+	extractor, _ := regexp.Compile("/login/([-0-9a-f]+)\\?email=([^\"]+)\"")
+	link := extractor.FindStringSubmatch(sent.Body)
+	assert.NotNil(t, link)
+	linkEmail, err := url.QueryUnescape(link[2])
+	assert.NoError(t, err)
+	assert.Equal(t, "alice@school.org", linkEmail)
+
+	// Opening the link doesn't consume it
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "/event/testevent/login/"+link[1], nil))
+	recorded.CodeIs(404)
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "/event/testevent/login", map[string]string{"code": link[1], "email": linkEmail}))
+	recorded.CodeIs(200)
+	aliceToken := services.SecurityToken{}
+	assert.NoError(t, recorded.DecodeJsonPayload(&aliceToken))
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/password", map[string]string{"newpassword": "alicepassword"}, aliceToken.Token))
+	recorded.CodeIs(200)
+
+	loginCreds := map[string]string{"username": "testevent/alice@school.org", "password": "alicepassword"}
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "/login", loginCreds))
+	recorded.CodeIs(200)
+	assert.NoError(t, recorded.DecodeJsonPayload(&aliceToken))
+
+	// Once logged in with a password, the current one is required
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/password", map[string]string{"newpassword": "otherpassword"}, aliceToken.Token))
+	recorded.CodeIs(403)
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/password", map[string]string{"password": "alicepassword", "newpassword": "otherpassword"}, aliceToken.Token))
+	recorded.CodeIs(200)
+
+	// The event admin password is unchanged
+	assert.True(t, services.CheckPassword(jeparticipe.EventService.GetEvent(event.Code).AdminPassword, event.Password))
+
+	// ------------------------------------
+	// An organizer is an admin of its event only
+	// ------------------------------------
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/bar/state/close", nil, aliceToken.Token))
+	recorded.CodeIs(200)
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("POST", "/event/testevent/organizers", map[string]string{"email": "bob@school.org"}, aliceToken.Token))
+	recorded.CodeIs(200)
+	assert.NoError(t, recorded.DecodeJsonPayload(&organizers))
+	assert.Len(t, organizers, 2)
+	assert.Equal(t, "testevent/alice@school.org", organizers[1].InvitedBy)
+	assert.Empty(t, organizers[0].PasswordHash)
+	assert.Empty(t, organizers[0].SessionNonce)
+
+	otherEvent, _ := entities.NewPendingConfirmationEvent("otherevent", "ip", "test@test.com")
+	jeparticipe.EventService.ConfirmAndSaveEvent(otherEvent)
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/otherevent/activity/bar/state/close", nil, aliceToken.Token))
+	recorded.CodeIs(403)
+
+	// ------------------------------------
+	// Revoked organizers can't log in nor use their token
+	// ------------------------------------
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("DELETE", "/event/testevent/organizers/unknown@school.org", nil, token))
+	recorded.CodeIs(404)
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("DELETE", "/event/testevent/organizers/alice@school.org", nil, token))
+	recorded.CodeIs(200)
+	assert.NoError(t, recorded.DecodeJsonPayload(&organizers))
+	assert.Len(t, organizers, 1)
+	assert.Equal(t, "bob@school.org", organizers[0].Email)
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/bar/state/open", nil, aliceToken.Token))
+	recorded.CodeIs(401)
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "/login", loginCreds))
+	recorded.CodeIs(401)
+
+	// ------------------------------------
+	// Invited again, the old tokens are still rejected
+	// ------------------------------------
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("POST", "/event/testevent/organizers", map[string]string{"email": "alice@school.org"}, token))
+	recorded.CodeIs(200)
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/bar/state/open", nil, aliceToken.Token))
+	recorded.CodeIs(401)
+
+	link = extractor.FindStringSubmatch(sent.Body)
+	assert.NotNil(t, link)
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "/event/testevent/login", map[string]string{"code": link[1], "email": linkEmail}))
+	recorded.CodeIs(200)
+	assert.NoError(t, recorded.DecodeJsonPayload(&aliceToken))
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/bar/state/open", nil, aliceToken.Token))
+	recorded.CodeIs(200)
+}
+
+func TestOrganizerRoles(t *testing.T) {
+	jeparticipe, handler, event := apptest.CreateATestApp()
+	defer apptest.DeleteTestApp(jeparticipe)
+	jeparticipe.EventService.EmailRelay = &email.EmailRelay{
+		Send: func(email *email.Email) error {
+			return nil
+		},
+	}
+
+	activity := jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code)
+	participant := activity.AddParticipant("public", "private", "111.111.111.111")
+	assert.NoError(t, jeparticipe.ActivityService.SaveActivity(activity, event.Code))
+	draft := jeparticipe.ActivityService.GetOrCreateActivity("cakes", event.Code)
+	draft.State = entities.StateDraft
+	assert.NoError(t, jeparticipe.ActivityService.SaveActivity(draft, event.Code))
+
+	token := apptest.GetAdminTokenForEvent(t, &handler, event)
+
+	// Returns a token for a new organizer with the given role
+	organizerToken := func(email string, role map[string]interface{}) string {
+		role["email"] = email
+		recorded := test.RunRequest(t, handler, apptest.MakeAdminRequest("POST", "/event/testevent/organizers", role, token))
+		recorded.CodeIs(200)
+
+		saved := jeparticipe.EventService.GetEvent(event.Code)
+		organizer := saved.GetOrganizer(email)
+		organizer.PasswordHash = services.HashPassword("password")
+		jeparticipe.EventService.SaveEvent(saved)
+
+		loginCreds := map[string]string{"username": services.GetOrganizerLogin(event.Code, email), "password": "password"}
+		recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "/login", loginCreds))
+		recorded.CodeIs(200)
+		nToken := services.SecurityToken{}
+		assert.NoError(t, recorded.DecodeJsonPayload(&nToken))
+		return nToken.Token
+	}
+
+	recorded := test.RunRequest(t, handler, apptest.MakeAdminRequest("POST", "/event/testevent/organizers", map[string]interface{}{"email": "x@school.org", "role": "king"}, token))
+	recorded.CodeIs(400)
+
+	// ------------------------------------
+	// Viewer reads private data only
+	// ------------------------------------
+
+	viewer := organizerToken("viewer@school.org", map[string]interface{}{"role": entities.RoleViewer})
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("GET", "/event/testevent/activities", nil, viewer))
+	recorded.CodeIs(200)
+	activities := []*entities.Activity{}
+	assert.NoError(t, recorded.DecodeJsonPayload(&activities))
+	assert.Len(t, activities, 2)
+	assert.Equal(t, "private", activities[0].Participants[0].PrivateText)
+
+	test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/bar/state/close", nil, viewer)).CodeIs(403)
+	test.RunRequest(t, handler, apptest.MakeAdminRequest("GET", "/event/testevent/activity/bar/participant/"+participant.Code+"/delete", nil, viewer)).CodeIs(403)
+	test.RunRequest(t, handler, apptest.MakeAdminRequest("GET", "/event/testevent/organizers", nil, viewer)).CodeIs(403)
+	test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/config", map[string]string{}, viewer)).CodeIs(403)
+	test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/password", map[string]string{"password": "password", "newpassword": "newpassword"}, viewer)).CodeIs(200)
+
+	// ------------------------------------
+	// Activity lead manages the participants of its activity
+	// ------------------------------------
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("POST", "/event/testevent/organizers", map[string]interface{}{"email": "lead@school.org", "role": entities.RoleLead}, token))
+	recorded.CodeIs(400)
+
+	// A lead manages a single activity of the event
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("POST", "/event/testevent/organizers", map[string]interface{}{"email": "lead@school.org", "role": entities.RoleLead, "activities": []string{"bar", "cakes"}}, token))
+	recorded.CodeIs(400)
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("POST", "/event/testevent/organizers", map[string]interface{}{"email": "lead@school.org", "role": entities.RoleLead, "activities": []string{"not a code"}}, token))
+	recorded.CodeIs(400)
+	assert.Nil(t, jeparticipe.EventService.GetEvent(event.Code).GetOrganizer("lead@school.org"))
+
+	// The activity may have no participant yet
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("POST", "/event/testevent/organizers", map[string]interface{}{"email": "wine@school.org", "role": entities.RoleLead, "activities": []string{"wine"}}, token))
+	recorded.CodeIs(200)
+	assert.True(t, jeparticipe.EventService.GetEvent(event.Code).GetOrganizer("wine@school.org").LeadsActivity("wine"))
+
+	lead := organizerToken("lead@school.org", map[string]interface{}{"role": entities.RoleLead, "activities": []string{"bar"}})
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("GET", "/event/testevent/activities", nil, lead))
+	assert.NoError(t, recorded.DecodeJsonPayload(&activities))
+	assert.Len(t, activities, 1)
+	assert.Equal(t, "private", activities[0].Participants[0].PrivateText)
+
+	test.RunRequest(t, handler, apptest.MakeAdminRequest("GET", "/event/testevent/activity/cakes", nil, lead)).CodeIs(404)
+	test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/bar", map[string]string{"Title": "Bar"}, lead)).CodeIs(403)
+	test.RunRequest(t, handler, apptest.MakeAdminRequest("GET", "/event/testevent/activity/bar/participant/"+participant.Code+"/delete", nil, lead)).CodeIs(200)
+
+	// ------------------------------------
+	// Manager edits activities, but not the event
+	// ------------------------------------
+
+	manager := organizerToken("manager@school.org", map[string]interface{}{"role": entities.RoleManager})
+	test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activity/cakes/state/open", nil, manager)).CodeIs(200)
+	test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activities/state/close", nil, manager)).CodeIs(200)
+	test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/activities/state/close", nil, lead)).CodeIs(403)
+	test.RunRequest(t, handler, apptest.MakeAdminRequest("DELETE", "/event/testevent", nil, manager)).CodeIs(403)
+
+	// ------------------------------------
+	// Role change, effective immediately
+	// ------------------------------------
+
+	test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/organizers/viewer@school.org", map[string]string{"role": entities.RoleOwner}, manager)).CodeIs(403)
+	test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/organizers/unknown@school.org", map[string]string{"role": entities.RoleOwner}, token)).CodeIs(404)
+	test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/organizers/viewer@school.org", map[string]string{"role": "king"}, token)).CodeIs(400)
+	test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/organizers/viewer@school.org", map[string]interface{}{"role": entities.RoleLead, "activities": []string{"not a code"}}, token)).CodeIs(400)
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("PUT", "/event/testevent/organizers/viewer@school.org", map[string]string{"role": entities.RoleOwner}, token))
+	recorded.CodeIs(200)
+	organizers := []*entities.Organizer{}
+	assert.NoError(t, recorded.DecodeJsonPayload(&organizers))
+	assert.Equal(t, entities.RoleOwner, organizers[0].Role)
+
+	test.RunRequest(t, handler, apptest.MakeAdminRequest("GET", "/event/testevent/organizers", nil, viewer)).CodeIs(200)
+}
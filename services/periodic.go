@@ -0,0 +1,33 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+// runEvery calls run in a goroutine at every interval, until the returned function is called
+// The returned function waits for the current run before returning
+func runEvery(interval time.Duration, run func(now time.Time)) func() {
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				run(now)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		wg.Wait()
+	}
+}
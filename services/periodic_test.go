@@ -0,0 +1,25 @@
+package services
+
+import (
+	"github.com/stretchr/testify/assert"
+
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunEvery(t *testing.T) {
+	var runs int32
+	stop := runEvery(time.Millisecond, func(now time.Time) {
+		atomic.AddInt32(&runs, 1)
+	})
+
+	time.Sleep(20 * time.Millisecond)
+	stop()
+	stopped := atomic.LoadInt32(&runs)
+	assert.True(t, stopped > 0)
+
+	// Nothing runs once stopped
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, stopped, atomic.LoadInt32(&runs))
+}
@@ -0,0 +1,84 @@
+package services
+
+import (
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/julienbayle/jeparticipe/entities"
+)
+
+// Permission is an action an organizer may be allowed to do on an event
+// Every handler states the permission it requires, PermissionPublic when anyone may call it
+type Permission int
+
+const (
+	// Anyone, even without a token
+	PermissionPublic Permission = iota
+
+	// Manage its own account
+	PermissionAccount
+
+	// Read the private data of the participants and the draft activities
+	PermissionReadPrivateData
+
+	// Add, edit and remove participants, even when the activity is closed
+	PermissionManageParticipants
+
+	// Edit activities, change their state and move participants between activities
+	PermissionEditActivities
+
+	// Change the event configuration, manage the organizers and delete the event
+	PermissionManageEvent
+
+	// Manage all the events and the server (superadmin only)
+	PermissionSuperAdmin
+)
+
+// Request environment key of the organizer logged in (set by Authorize)
+const OrganizerEnvKey = "ORGANIZER"
+
+var rolePermissions = map[string][]Permission{
+	entities.RoleOwner:   {PermissionAccount, PermissionReadPrivateData, PermissionManageParticipants, PermissionEditActivities, PermissionManageEvent},
+	entities.RoleManager: {PermissionAccount, PermissionReadPrivateData, PermissionManageParticipants, PermissionEditActivities},
+	entities.RoleViewer:  {PermissionAccount, PermissionReadPrivateData},
+	entities.RoleLead:    {PermissionAccount, PermissionReadPrivateData, PermissionManageParticipants},
+}
+
+// hasPermission checks that current user has the permission on the event and the activity of the request
+func hasPermission(r *rest.Request, permission Permission) bool {
+	return hasActivityPermission(r, permission, getActivityCodeFromRequest(r))
+}
+
+// hasActivityPermission checks that current user has the permission on the event of the request and the given activity
+// The superadmin and the event admin are owners, an activity lead only has permissions on its activities
+func hasActivityPermission(r *rest.Request, permission Permission, activityCode string) bool {
+	switch permission {
+	case PermissionPublic:
+		return true
+	case PermissionSuperAdmin:
+		return hasSuperAdminPriviledge(r)
+	}
+
+	if !hasAdminPriviledge(r) {
+		return false
+	}
+
+	user := r.Env["REMOTE_USER"].(string)
+	if user == SuperAdminLogin || user == GetEventAdminLogin(getEventCodeFromRequest(r)) {
+		return true
+	}
+
+	organizer, ok := r.Env[OrganizerEnvKey].(*entities.Organizer)
+	if !ok {
+		return false
+	}
+
+	if organizer.GetRole() == entities.RoleLead && permission != PermissionAccount && !organizer.LeadsActivity(activityCode) {
+		return false
+	}
+
+	for _, p := range rolePermissions[organizer.GetRole()] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
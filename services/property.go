@@ -8,12 +8,13 @@ type Property struct {
 	Value string
 }
 
-func GetProperty(repositoryService *RepositoryService, code string, defautValue string) string {
+// GetProperty returns a property value from the store or saves and returns the default value
+func GetProperty(store Store, code string, defautValue string) string {
 	prop := &Property{}
-	err := repositoryService.GetDocument(PropertiesBucketName, code, prop)
+	err := store.GetDocument(PropertiesBucketName, code, prop)
 	if err != nil || prop.Value == "" {
 		prop.Value = defautValue
-		repositoryService.CommitDocument(PropertiesBucketName, code, prop)
+		store.CommitDocument(PropertiesBucketName, code, prop)
 	}
 	return prop.Value
 }
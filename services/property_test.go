@@ -17,4 +17,11 @@ func TestProperties(t *testing.T) {
 
 	assert.Equal(t, "a", GetProperty(repositoryService, "code", "a"))
 	assert.Equal(t, "a", GetProperty(repositoryService, "code", "b"))
+
+	memoryStore := NewMemoryStore()
+	defer memoryStore.ShutDown()
+
+	memoryStore.CreateCollectionIfNotExists(PropertiesBucketName)
+	assert.Equal(t, "a", GetProperty(memoryStore, "code", "a"))
+	assert.Equal(t, "a", GetProperty(memoryStore, "code", "b"))
 }
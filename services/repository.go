@@ -2,16 +2,24 @@ package services
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/ant0ine/go-json-rest/rest"
 	"github.com/boltdb/bolt"
 )
 
+// RepositoryService is the BoltDB implementation of Store
 type RepositoryService struct {
-	Db *bolt.DB
+	// Only used with the lock held (the database is replaced by a restore)
+	db *bolt.DB
+
+	// Write lock is held while the database file is closed or replaced
+	mutex sync.RWMutex
 }
 
 // NewRepositoryService opens existing database or creates a new one
@@ -21,17 +29,40 @@ func NewRepositoryService(dbFilePath string) *RepositoryService {
 		panic("Unable to create database " + err.Error())
 	}
 
-	return &RepositoryService{Db: Db}
+	return &RepositoryService{db: Db}
+}
+
+// Path returns the path of the database file
+func (rs *RepositoryService) Path() string {
+	rs.mutex.RLock()
+	defer rs.mutex.RUnlock()
+	return rs.db.Path()
 }
 
 // ShutDown closes the database (do defer this)
 func (rs *RepositoryService) ShutDown() {
-	rs.Db.Close()
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	rs.db.Close()
+}
+
+// view runs a read-only bolt transaction
+func (rs *RepositoryService) view(fn func(*bolt.Tx) error) error {
+	rs.mutex.RLock()
+	defer rs.mutex.RUnlock()
+	return rs.db.View(fn)
+}
+
+// update runs a read-write bolt transaction
+func (rs *RepositoryService) update(fn func(*bolt.Tx) error) error {
+	rs.mutex.RLock()
+	defer rs.mutex.RUnlock()
+	return rs.db.Update(fn)
 }
 
 // CreateCollectionIfNotExists creates a new document collection
 func (rs *RepositoryService) CreateCollectionIfNotExists(collection string) error {
-	return rs.Db.Update(func(tx *bolt.Tx) error {
+	return rs.update(func(tx *bolt.Tx) error {
 		_, err := tx.CreateBucketIfNotExists([]byte(collection))
 		if err != nil {
 			panic("Unable to create bucket " + err.Error())
@@ -40,10 +71,43 @@ func (rs *RepositoryService) CreateCollectionIfNotExists(collection string) erro
 	})
 }
 
+// GetCollections returns the names of the collections starting with prefix
+func (rs *RepositoryService) GetCollections(prefix string) ([]string, error) {
+	collections := make([]string, 0)
+	err := rs.view(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if strings.HasPrefix(string(name), prefix) {
+				collections = append(collections, string(name))
+			}
+			return nil
+		})
+	})
+	return collections, err
+}
+
+// GetIdentifiers returns the identifiers of the documents of a collection
+func (rs *RepositoryService) GetIdentifiers(collection string) ([]string, error) {
+	identifiers := make([]string, 0)
+	err := rs.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(collection))
+		if b == nil {
+			return errors.New("Collection " + collection + " does not exist")
+		}
+		return b.ForEach(func(k, v []byte) error {
+			identifiers = append(identifiers, string(k))
+			return nil
+		})
+	})
+	return identifiers, err
+}
+
 // GetDocument gets a document from a collection
 func (rs *RepositoryService) GetDocument(collection string, identifier string, document interface{}) error {
-	return rs.Db.View(func(tx *bolt.Tx) error {
+	return rs.view(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(collection))
+		if b == nil {
+			return errors.New("Collection " + collection + " does not exist")
+		}
 		v := b.Get([]byte(identifier))
 		if v != nil {
 			if err := json.Unmarshal(v, document); err != nil {
@@ -56,21 +120,160 @@ func (rs *RepositoryService) GetDocument(collection string, identifier string, d
 
 // CommitDocument commits a document to the database (create / update)
 func (rs *RepositoryService) CommitDocument(collection string, identifier string, document interface{}) error {
-	return rs.Db.Update(func(tx *bolt.Tx) error {
+	return rs.update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(collection))
+		if b == nil {
+			return errors.New("Collection " + collection + " does not exist")
+		}
 		data, _ := json.Marshal(document)
 		return b.Put([]byte(identifier), data)
 	})
 }
 
+// UpdateDocument loads, updates and commits a document in a single transaction
+func (rs *RepositoryService) UpdateDocument(collection string, identifier string, document interface{}, update func() error) error {
+	return rs.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(collection))
+		if b == nil {
+			return errors.New("Collection " + collection + " does not exist")
+		}
+		if v := b.Get([]byte(identifier)); v != nil {
+			if err := json.Unmarshal(v, document); err != nil {
+				return err
+			}
+		}
+		if err := update(); err != nil {
+			return err
+		}
+		data, err := json.Marshal(document)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(identifier), data)
+	})
+}
+
+// UpdateDocumentGroup loads, updates and commits several documents in a single transaction
+func (rs *RepositoryService) UpdateDocumentGroup(collection string, identifiers []string, documents []interface{}, update func() error) error {
+	return rs.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(collection))
+		if b == nil {
+			return errors.New("Collection " + collection + " does not exist")
+		}
+		for i, identifier := range identifiers {
+			if v := b.Get([]byte(identifier)); v != nil {
+				if err := json.Unmarshal(v, documents[i]); err != nil {
+					return err
+				}
+			}
+		}
+		if err := update(); err != nil {
+			return err
+		}
+		for i, identifier := range identifiers {
+			data, err := json.Marshal(documents[i])
+			if err != nil {
+				return err
+			}
+			if err = b.Put([]byte(identifier), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UpdateDocuments loads, updates and commits all the documents of a collection in a single transaction
+func (rs *RepositoryService) UpdateDocuments(collection string, newDocument func(identifier string) interface{}, update func(identifier string, document interface{}) (bool, error)) error {
+	return rs.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(collection))
+		if b == nil {
+			return errors.New("Collection " + collection + " does not exist")
+		}
+
+		// Bucket can not be modified while iterating
+		identifiers := make([]string, 0)
+		b.ForEach(func(k, v []byte) error {
+			identifiers = append(identifiers, string(k))
+			return nil
+		})
+
+		for _, identifier := range identifiers {
+			document := newDocument(identifier)
+			if err := json.Unmarshal(b.Get([]byte(identifier)), document); err != nil {
+				return err
+			}
+			changed, err := update(identifier, document)
+			if err != nil {
+				return err
+			}
+			if !changed {
+				continue
+			}
+			data, err := json.Marshal(document)
+			if err != nil {
+				return err
+			}
+			if err = b.Put([]byte(identifier), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteDocument removes a document from a collection
+func (rs *RepositoryService) DeleteDocument(collection string, identifier string) error {
+	return rs.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(collection))
+		if b == nil {
+			return errors.New("Collection " + collection + " does not exist")
+		}
+		return b.Delete([]byte(identifier))
+	})
+}
+
+// DeleteDocumentIf loads a document and removes it if check returns true in a single transaction
+func (rs *RepositoryService) DeleteDocumentIf(collection string, identifier string, document interface{}, check func() bool) (bool, error) {
+	removed := false
+	err := rs.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(collection))
+		if b == nil {
+			return errors.New("Collection " + collection + " does not exist")
+		}
+		if v := b.Get([]byte(identifier)); v != nil {
+			if err := json.Unmarshal(v, document); err != nil {
+				return err
+			}
+		}
+		if !check() {
+			return nil
+		}
+		removed = true
+		return b.Delete([]byte(identifier))
+	})
+	return removed && err == nil, err
+}
+
+// DeleteCollection removes a collection and all its documents
+func (rs *RepositoryService) DeleteCollection(collection string) error {
+	return rs.update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(collection))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
 // GetBackup returns the database dump
 func (es *RepositoryService) Backup(w rest.ResponseWriter, r *rest.Request) {
-	if !hasSuperAdminPriviledge(r) {
+	if !hasPermission(r, PermissionSuperAdmin) {
 		rest.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
-	err := es.Db.View(func(tx *bolt.Tx) error {
+	err := es.view(func(tx *bolt.Tx) error {
 		w.Header().Set("Content-Type", "application/octet-stream")
 		w.Header().Set("Content-Disposition", `attachment; filename="backup.db"`)
 		w.Header().Set("Content-Length", strconv.Itoa(int(tx.Size())))
@@ -6,6 +6,7 @@ import (
 	"github.com/julienbayle/jeparticipe/services"
 	"github.com/stretchr/testify/assert"
 
+	"errors"
 	"os"
 	"testing"
 )
@@ -17,29 +18,170 @@ type testData struct {
 
 func TestBoltRepository(t *testing.T) {
 	repositoryService := services.NewRepositoryService("repo.db")
-	defer repositoryService.ShutDown()
 	defer os.Remove("repo.db")
+	defer repositoryService.ShutDown()
 
 	assert.NotNil(t, repositoryService)
+	testStore(t, repositoryService)
+}
 
-	repositoryService.CreateCollectionIfNotExists("testcollection")
+func TestMemoryRepository(t *testing.T) {
+	memoryStore := services.NewMemoryStore()
+	defer memoryStore.ShutDown()
 
+	assert.NotNil(t, memoryStore)
+	testStore(t, memoryStore)
+}
+
+// testStore checks the behaviour every store implementation should share
+func testStore(t *testing.T, store services.Store) {
 	data := &testData{}
-	assert.Nil(t, repositoryService.GetDocument("testcollection", "testid", data))
+	assert.Error(t, store.GetDocument("testcollection", "testid", data))
+	assert.Error(t, store.CommitDocument("testcollection", "testid", data))
+
+	assert.Nil(t, store.CreateCollectionIfNotExists("testcollection"))
+	assert.Nil(t, store.CreateCollectionIfNotExists("testcollection"))
+
+	assert.Nil(t, store.GetDocument("testcollection", "testid", data))
+	assert.Equal(t, "", data.Field1)
 
 	data.Field1 = "Field1"
 	data.field2 = "field2"
 
-	assert.Nil(t, repositoryService.CommitDocument("testcollection", "testid", data))
+	assert.Nil(t, store.CommitDocument("testcollection", "testid", data))
 
 	recoverData := &testData{}
-	assert.Nil(t, repositoryService.GetDocument("testcollection", "testid", recoverData))
+	assert.Nil(t, store.GetDocument("testcollection", "testid", recoverData))
 	assert.Equal(t, data.Field1, recoverData.Field1)
 	assert.Equal(t, "", recoverData.field2)
+
+	updateData := &testData{}
+	assert.Nil(t, store.UpdateDocument("testcollection", "testid", updateData, func() error {
+		assert.Equal(t, "Field1", updateData.Field1)
+		updateData.Field1 = "Updated"
+		return nil
+	}))
+	assert.Error(t, store.UpdateDocument("testcollection", "testid", updateData, func() error {
+		updateData.Field1 = "Not saved"
+		return errors.New("Abort")
+	}))
+
+	recoverData = &testData{}
+	assert.Nil(t, store.GetDocument("testcollection", "testid", recoverData))
+	assert.Equal(t, "Updated", recoverData.Field1)
+
+	assert.Nil(t, store.CreateCollectionIfNotExists("testcollection2"))
+	assert.Nil(t, store.CreateCollectionIfNotExists("othercollection"))
+	assert.Nil(t, store.CommitDocument("testcollection", "anotherid", data))
+
+	collections, err := store.GetCollections("test")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"testcollection", "testcollection2"}, collections)
+
+	identifiers, err := store.GetIdentifiers("testcollection")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"anotherid", "testid"}, identifiers)
+
+	identifiers, err = store.GetIdentifiers("testcollection2")
+	assert.Nil(t, err)
+	assert.Len(t, identifiers, 0)
+
+	_, err = store.GetIdentifiers("donotexist")
+	assert.Error(t, err)
+
+	group := []interface{}{&testData{}, &testData{}}
+	assert.Nil(t, store.UpdateDocumentGroup("testcollection", []string{"testid", "newid"}, group, func() error {
+		assert.Equal(t, "Updated", group[0].(*testData).Field1)
+		assert.Equal(t, "", group[1].(*testData).Field1)
+		group[1].(*testData).Field1 = group[0].(*testData).Field1
+		group[0].(*testData).Field1 = "Moved"
+		return nil
+	}))
+	assert.Error(t, store.UpdateDocumentGroup("testcollection", []string{"testid", "newid"}, group, func() error {
+		group[0].(*testData).Field1 = "Not saved"
+		return errors.New("Abort")
+	}))
+	assert.Error(t, store.UpdateDocumentGroup("donotexist", []string{"testid"}, group[:1], func() error {
+		return nil
+	}))
+
+	recoverData = &testData{}
+	assert.Nil(t, store.GetDocument("testcollection", "newid", recoverData))
+	assert.Equal(t, "Updated", recoverData.Field1)
+	recoverData = &testData{}
+	assert.Nil(t, store.GetDocument("testcollection", "testid", recoverData))
+	assert.Equal(t, "Moved", recoverData.Field1)
+	assert.Nil(t, store.DeleteDocument("testcollection", "newid"))
+	assert.Nil(t, store.CommitDocument("testcollection", "testid", &testData{Field1: "Updated"}))
+
+	newData := func(identifier string) interface{} {
+		return &testData{}
+	}
+	assert.Nil(t, store.UpdateDocuments("testcollection", newData, func(identifier string, document interface{}) (bool, error) {
+		if identifier == "testid" {
+			return false, nil
+		}
+		document.(*testData).Field1 = "Bulk"
+		return true, nil
+	}))
+	assert.Error(t, store.UpdateDocuments("testcollection", newData, func(identifier string, document interface{}) (bool, error) {
+		if identifier == "testid" {
+			return false, errors.New("Abort")
+		}
+		document.(*testData).Field1 = "Not saved"
+		return true, nil
+	}))
+	assert.Error(t, store.UpdateDocuments("donotexist", newData, func(identifier string, document interface{}) (bool, error) {
+		return true, nil
+	}))
+
+	recoverData = &testData{}
+	assert.Nil(t, store.GetDocument("testcollection", "anotherid", recoverData))
+	assert.Equal(t, "Bulk", recoverData.Field1)
+	recoverData = &testData{}
+	assert.Nil(t, store.GetDocument("testcollection", "testid", recoverData))
+	assert.Equal(t, "Updated", recoverData.Field1)
+
+	checked := &testData{}
+	removed, err := store.DeleteDocumentIf("testcollection", "anotherid", checked, func() bool {
+		return checked.Field1 != "Bulk"
+	})
+	assert.Nil(t, err)
+	assert.False(t, removed)
+	removed, err = store.DeleteDocumentIf("testcollection", "anotherid", checked, func() bool {
+		return checked.Field1 == "Bulk"
+	})
+	assert.Nil(t, err)
+	assert.True(t, removed)
+	_, err = store.DeleteDocumentIf("donotexist", "testid", checked, func() bool {
+		return true
+	})
+	assert.Error(t, err)
+
+	assert.Nil(t, store.CommitDocument("testcollection", "anotherid", data))
+	assert.Nil(t, store.DeleteDocument("testcollection", "anotherid"))
+	assert.Nil(t, store.DeleteDocument("testcollection", "anotherid"))
+	identifiers, err = store.GetIdentifiers("testcollection")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"testid"}, identifiers)
+	assert.Error(t, store.DeleteDocument("donotexist", "testid"))
+
+	assert.Nil(t, store.DeleteCollection("testcollection"))
+	assert.Nil(t, store.DeleteCollection("donotexist"))
+	collections, err = store.GetCollections("test")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"testcollection2"}, collections)
+	assert.Error(t, store.GetDocument("testcollection", "testid", recoverData))
+
+	assert.Nil(t, store.CreateCollectionIfNotExists("testcollection"))
+	identifiers, err = store.GetIdentifiers("testcollection")
+	assert.Nil(t, err)
+	assert.Len(t, identifiers, 0)
 }
 
 func TestBackup(t *testing.T) {
-	jeparticipe, handler, event := apptest.CreateATestApp()
+	jeparticipe, handler, event := apptest.CreateATestAppWithStore(services.NewRepositoryService("backup.db"))
+	defer os.Remove("backup.db")
 	defer apptest.DeleteTestApp(jeparticipe)
 
 	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "/backup", nil))
@@ -57,4 +199,16 @@ func TestBackup(t *testing.T) {
 	recorded = test.RunRequest(t, handler, rq)
 	recorded.CodeIs(200)
 	recorded.HeaderIs("Content-Type", "application/octet-stream")
+
+	// ------------------------------------
+	// No raw backup with a memory store
+	// ------------------------------------
+
+	memoryApp, memoryHandler, _ := apptest.CreateATestApp()
+	defer apptest.DeleteTestApp(memoryApp)
+
+	token = apptest.GetSuperAdminToken(t, &memoryHandler, memoryApp)
+	rq = apptest.MakeAdminRequest("GET", "/backup", nil, token)
+	recorded = test.RunRequest(t, memoryHandler, rq)
+	recorded.CodeIs(404)
 }
@@ -0,0 +1,157 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/julienbayle/jeparticipe/entities"
+)
+
+const (
+	// Default delay between a participant deletion date and its physical removal
+	DefaultRetention = 30 * 24 * time.Hour
+)
+
+var (
+	errNothingToPurge = errors.New("Nothing to purge")
+)
+
+// RetentionService physically removes participants once their deletion date is older than the retention delay
+type RetentionService struct {
+	ActivityService *ActivityService
+
+	// Delay between a participant deletion date and its physical removal
+	Retention time.Duration
+
+	// Delay between two purges
+	Interval time.Duration
+
+	stop func()
+}
+
+type PurgeReport struct {
+	DryRun       bool              `json:"dryRun"`
+	Before       time.Time         `json:"before"`
+	Participants int               `json:"participants"`
+	Headcount    int               `json:"headcount"`
+	Activities   []*PurgedActivity `json:"activities"`
+}
+
+type PurgedActivity struct {
+	Event        string `json:"event"`
+	Activity     string `json:"activity"`
+	Participants int    `json:"participants"`
+	Headcount    int    `json:"headcount"`
+}
+
+// Start purges expired participants and then purges again at every interval
+func (rs *RetentionService) Start() error {
+	if _, err := rs.Purge(false); err != nil {
+		return err
+	}
+
+	rs.stop = runEvery(rs.Interval, func(now time.Time) {
+		if report, err := rs.Purge(false); err != nil {
+			log.Printf("Purge failed : %s", err)
+		} else if report.Participants > 0 {
+			log.Printf("%d participants purged", report.Participants)
+		}
+	})
+	return nil
+}
+
+// Stop waits for the current purge and stops the scheduler
+func (rs *RetentionService) Stop() {
+	if rs.stop != nil {
+		rs.stop()
+		rs.stop = nil
+	}
+}
+
+// Purge removes the participants and waiting list entries deleted before the retention delay from all the activities of all the events
+// Nothing is removed in dry run mode, the report lists what would be removed
+func (rs *RetentionService) Purge(dryRun bool) (*PurgeReport, error) {
+	report := &PurgeReport{
+		DryRun:     dryRun,
+		Before:     time.Now().Add(-rs.Retention),
+		Activities: make([]*PurgedActivity, 0),
+	}
+
+	store := rs.ActivityService.Store
+	collections, err := store.GetCollections(GetActivityBucketName(""))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, collection := range collections {
+		eventCode := strings.TrimPrefix(collection, GetActivityBucketName(""))
+		activityCodes, err := store.GetIdentifiers(collection)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, activityCode := range activityCodes {
+			var purged []*entities.Participant
+			if dryRun {
+				purged = rs.ActivityService.GetOrCreateActivity(activityCode, eventCode).PurgeParticipants(report.Before)
+			} else {
+				_, err = rs.ActivityService.UpdateActivity(activityCode, eventCode, func(activity *entities.Activity) error {
+					purged = activity.PurgeParticipants(report.Before)
+					if len(purged) == 0 {
+						return errNothingToPurge
+					}
+					return nil
+				})
+				if err != nil && err != errNothingToPurge {
+					return nil, err
+				}
+			}
+
+			if len(purged) > 0 {
+				headcount := 0
+				for _, participant := range purged {
+					headcount += participant.HeadCount()
+				}
+				report.Participants += len(purged)
+				report.Headcount += headcount
+				report.Activities = append(report.Activities, &PurgedActivity{
+					Event:        eventCode,
+					Activity:     activityCode,
+					Participants: len(purged),
+					Headcount:    headcount,
+				})
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// GetPurgeReport returns what would be purged now (superadmin only)
+func (rs *RetentionService) GetPurgeReport(w rest.ResponseWriter, r *rest.Request) {
+	rs.purge(w, r, true)
+}
+
+// PurgeParticipants removes expired participants now (superadmin only)
+func (rs *RetentionService) PurgeParticipants(w rest.ResponseWriter, r *rest.Request) {
+	rs.purge(w, r, false)
+}
+
+// purge is a convenient method to run a purge from a request
+func (rs *RetentionService) purge(w rest.ResponseWriter, r *rest.Request, dryRun bool) {
+	if !hasPermission(r, PermissionSuperAdmin) {
+		rest.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	report, err := rs.Purge(dryRun)
+	if err != nil {
+		panic(err)
+	}
+
+	w.WriteJson(report)
+}
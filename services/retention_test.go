@@ -0,0 +1,105 @@
+package services_test
+
+import (
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"github.com/julienbayle/jeparticipe/app/test"
+	"github.com/julienbayle/jeparticipe/entities"
+	"github.com/julienbayle/jeparticipe/services"
+	"github.com/stretchr/testify/assert"
+
+	"testing"
+	"time"
+)
+
+func TestPurgeParticipants(t *testing.T) {
+	jeparticipe, handler, event := apptest.CreateATestApp()
+	defer apptest.DeleteTestApp(jeparticipe)
+
+	// ------------------------------------
+	// Participants in two events, one is deleted for a long time
+	// ------------------------------------
+
+	activity := jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code)
+	expired := activity.AddParticipant("public", "0600000000", "111.111.111.111")
+	expired.DeletedAt = time.Now().AddDate(0, -2, 0)
+	expired.Count = 3
+	recent := activity.AddParticipant("public", "private", "ip")
+	activity.RemoveParticipant(recent.Code)
+	activity.AddParticipant("public", "private", "ip")
+	assert.NoError(t, jeparticipe.ActivityService.SaveActivity(activity, event.Code))
+
+	otherEvent, _ := entities.NewPendingConfirmationEvent("otherevent", "ip", "test@test.com")
+	jeparticipe.EventService.ConfirmAndSaveEvent(otherEvent)
+	otherActivity := jeparticipe.ActivityService.GetOrCreateActivity("cakes", otherEvent.Code)
+	otherActivity.AddParticipant("public", "private", "ip").DeletedAt = time.Now().AddDate(-1, 0, 0)
+	waitlisted := otherActivity.AddToWaitlist("public", "private", "ip")
+	waitlisted.Email = "waiting@test.com"
+	waitlisted.DeletedAt = time.Now().AddDate(0, -2, 0)
+	otherActivity.AddToWaitlist("public", "private", "ip")
+	assert.NoError(t, jeparticipe.ActivityService.SaveActivity(otherActivity, otherEvent.Code))
+
+	// ------------------------------------
+	// Permissions
+	// ------------------------------------
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "/purge", nil))
+	recorded.CodeIs(403)
+
+	token := apptest.GetAdminTokenForEvent(t, &handler, event)
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("POST", "/purge", nil, token))
+	recorded.CodeIs(403)
+
+	// ------------------------------------
+	// Dry run
+	// ------------------------------------
+
+	token = apptest.GetSuperAdminToken(t, &handler, jeparticipe)
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("GET", "/purge", nil, token))
+	recorded.CodeIs(200)
+
+	report := &services.PurgeReport{}
+	assert.NoError(t, recorded.DecodeJsonPayload(report))
+	assert.True(t, report.DryRun)
+	assert.Equal(t, 3, report.Participants)
+	assert.Equal(t, 5, report.Headcount)
+	assert.Len(t, report.Activities, 2)
+	assert.Equal(t, &services.PurgedActivity{Event: "otherevent", Activity: "cakes", Participants: 2, Headcount: 2}, report.Activities[0])
+	assert.Equal(t, &services.PurgedActivity{Event: "testevent", Activity: "bar", Participants: 1, Headcount: 3}, report.Activities[1])
+
+	assert.Len(t, jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code).Participants, 3)
+
+	// ------------------------------------
+	// Purge
+	// ------------------------------------
+
+	recorded = test.RunRequest(t, handler, apptest.MakeAdminRequest("POST", "/purge", nil, token))
+	recorded.CodeIs(200)
+
+	report = &services.PurgeReport{}
+	assert.NoError(t, recorded.DecodeJsonPayload(report))
+	assert.False(t, report.DryRun)
+	assert.Equal(t, 3, report.Participants)
+
+	activity = jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code)
+	assert.Len(t, activity.Participants, 2)
+	assert.Nil(t, activity.GetParticipant(expired.Code))
+	assert.NotNil(t, activity.GetParticipant(recent.Code))
+	otherActivity = jeparticipe.ActivityService.GetOrCreateActivity("cakes", otherEvent.Code)
+	assert.Len(t, otherActivity.Participants, 0)
+	assert.Len(t, otherActivity.Waitlist, 1)
+	assert.Nil(t, otherActivity.GetWaitlisted(waitlisted.Code))
+
+	// ------------------------------------
+	// Nothing left to purge with the default retention, everything with no retention
+	// ------------------------------------
+
+	report, err := jeparticipe.RetentionService.Purge(false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, report.Participants)
+
+	jeparticipe.RetentionService.Retention = 0
+	report, err = jeparticipe.RetentionService.Purge(false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Participants)
+	assert.Nil(t, jeparticipe.ActivityService.GetOrCreateActivity("bar", event.Code).GetParticipant(recent.Code))
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/julienbayle/jeparticipe/entities"
+)
+
+var (
+	errNothingScheduled = errors.New("Nothing scheduled")
+)
+
+// ScheduleService periodically applies the scheduled openings and closings of the activities
+type ScheduleService struct {
+	ActivityService *ActivityService
+
+	// Delay between two checks
+	Interval time.Duration
+
+	stop func()
+}
+
+// Start applies the due transitions and then checks again at every interval
+func (ss *ScheduleService) Start() error {
+	if _, err := ss.ApplySchedules(time.Now()); err != nil {
+		return err
+	}
+
+	ss.stop = runEvery(ss.Interval, func(now time.Time) {
+		if changed, err := ss.ApplySchedules(now); err != nil {
+			log.Printf("Scheduled state changes failed : %s", err)
+		} else if changed > 0 {
+			log.Printf("%d activities changed by their schedule", changed)
+		}
+	})
+	return nil
+}
+
+// Stop waits for the current check and stops the scheduler
+func (ss *ScheduleService) Stop() {
+	if ss.stop != nil {
+		ss.stop()
+		ss.stop = nil
+	}
+}
+
+// ApplySchedules applies the transitions due at the given time to all the activities of all the events
+// The activities are read first, only the ones with a due transition are updated (and checked again)
+// Returns the number of changed activities
+func (ss *ScheduleService) ApplySchedules(now time.Time) (int, error) {
+	collections, err := ss.ActivityService.Store.GetCollections(GetActivityBucketName(""))
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, collection := range collections {
+		eventCode := strings.TrimPrefix(collection, GetActivityBucketName(""))
+		activities, err := ss.ActivityService.GetAllActivities(eventCode)
+		if err != nil {
+			return changed, err
+		}
+
+		for _, due := range activities {
+			// Applied to the copy read, to find out whether a transition is due
+			if !due.ApplySchedule(now) {
+				continue
+			}
+
+			_, err = ss.ActivityService.UpdateActivity(due.Code, eventCode, func(activity *entities.Activity) error {
+				if !activity.ApplySchedule(now) {
+					return errNothingScheduled
+				}
+				return nil
+			})
+			if err == nil {
+				changed++
+			} else if err != errNothingScheduled {
+				return changed, err
+			}
+		}
+	}
+	return changed, nil
+}
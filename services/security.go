@@ -4,13 +4,31 @@ import (
 	"crypto/rand"
 	"io"
 	"strings"
+	"time"
 
 	"github.com/ant0ine/go-json-rest/rest"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/julienbayle/jeparticipe/entities"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const (
 	SuperAdminLogin  = "superadmin"
 	AdminLoginSuffix = "admin"
+
+	// Separates the event code and the email in an organizer login
+	OrganizerLoginSeparator = "/"
+
+	// Property holding the superadmin password hash
+	SuperAdminPasswordProperty = "superadminpass"
+
+	// JWT claim marking the tokens given by a login link
+	LoginLinkClaim = "link"
+
+	// JWT claim binding the token of an organizer to its invitation
+	SessionClaim = "session"
+
+	MinPasswordLength = 8
 )
 
 var (
@@ -21,7 +39,8 @@ type SecurityToken struct {
 	Token string `json:"token"`
 }
 
-// hasAdminPriviledge checks that current user has admin priviledge
+// hasAdminPriviledge checks that current user is the superadmin or an organizer of the event, whatever its role
+// Use hasPermission to check what the user is allowed to do
 func hasAdminPriviledge(r *rest.Request) bool {
 	user := r.Env["REMOTE_USER"]
 	eventCode := getEventCodeFromRequest(r)
@@ -34,11 +53,17 @@ func hasAdminPriviledge(r *rest.Request) bool {
 		return true
 	}
 
-	if eventCode != "" {
-		return user.(string) == GetEventAdminLogin(eventCode)
+	if eventCode == "" {
+		return false
 	}
 
-	return false
+	if user.(string) == GetEventAdminLogin(eventCode) {
+		return true
+	}
+
+	// The organizer has been found in the event by Authorize
+	organizer, ok := r.Env[OrganizerEnvKey].(*entities.Organizer)
+	return ok && user.(string) == GetOrganizerLogin(eventCode, organizer.Email)
 }
 
 // hasSuperAdminPriviledge checks that current user has super admin priviledge
@@ -51,20 +76,162 @@ func GetEventAdminLogin(eventCode string) string {
 	return eventCode + "-" + AdminLoginSuffix
 }
 
-func Authenticate(eventService *EventService, superAdminPassword string, userId string, password string) bool {
+// GetOrganizerLogin returns the login of an organizer (event code and email)
+func GetOrganizerLogin(eventCode string, email string) string {
+	return eventCode + OrganizerLoginSeparator + strings.ToLower(email)
+}
+
+// getOrganizerFromLogin returns the event and the organizer of an organizer login, nil if the organizer does not exist
+func getOrganizerFromLogin(eventService *EventService, userId string) (*entities.Event, *entities.Organizer) {
+	userIdParts := strings.SplitN(userId, OrganizerLoginSeparator, 2)
+	if len(userIdParts) != 2 {
+		return nil, nil
+	}
+
+	event := eventService.GetEvent(userIdParts[0])
+	if event == nil || !event.EmailConfirmed {
+		return nil, nil
+	}
+
+	organizer := event.GetOrganizer(userIdParts[1])
+	if organizer == nil {
+		return nil, nil
+	}
+	return event, organizer
+}
+
+func Authenticate(eventService *EventService, superAdminHash string, userId string, password string) bool {
 	if userId == SuperAdminLogin {
-		return password == superAdminPassword
+		return CheckPassword(superAdminHash, password)
+	}
+
+	if strings.Contains(userId, OrganizerLoginSeparator) {
+		_, organizer := getOrganizerFromLogin(eventService, userId)
+		return organizer != nil && CheckPassword(organizer.PasswordHash, password)
 	}
 
 	userIdParts := strings.Split(userId, "-")
 	if len(userIdParts) == 2 && userIdParts[1] == AdminLoginSuffix {
 		event := eventService.GetEvent(userIdParts[0])
-		return event != nil && password == event.AdminPassword
+		return event != nil && event.EmailConfirmed && CheckPassword(event.AdminPassword, password)
 	}
 
 	return false
 }
 
+// Authorize checks that the user of a JWT token is still allowed (an organizer can be revoked)
+// The token of an organizer must be bound to its current invitation, so that a revoked then invited again organizer
+// can't use its old tokens
+// The organizer is kept in the request environment to check its permissions
+func Authorize(eventService *EventService, userId string, r *rest.Request) bool {
+	if strings.Contains(userId, OrganizerLoginSeparator) {
+		_, organizer := getOrganizerFromLogin(eventService, userId)
+		if organizer == nil {
+			return false
+		}
+		if session, _ := getTokenClaims(r)[SessionClaim].(string); session != organizer.SessionNonce {
+			return false
+		}
+		r.Env[OrganizerEnvKey] = organizer
+	}
+	return true
+}
+
+// TokenPayload returns the additional claims of the JWT token of a user
+func TokenPayload(eventService *EventService, userId string) map[string]interface{} {
+	payload := make(map[string]interface{})
+	if strings.Contains(userId, OrganizerLoginSeparator) {
+		if _, organizer := getOrganizerFromLogin(eventService, userId); organizer != nil {
+			payload[SessionClaim] = organizer.SessionNonce
+		}
+	}
+	return payload
+}
+
+// NewLoginLinkToken returns a JWT token for a user logged in with a login link
+// It has the same claims as the tokens given by the login handler, and is marked with the login link claim
+func NewLoginLinkToken(eventService *EventService, userId string) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{}
+	for k, v := range TokenPayload(eventService, userId) {
+		claims[k] = v
+	}
+	claims["id"] = userId
+	claims["exp"] = now.Add(eventService.TokenTimeout).Unix()
+	claims["orig_iat"] = now.Unix()
+	claims[LoginLinkClaim] = true
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(eventService.Secret))
+}
+
+// getTokenClaims returns the claims of the JWT token of the request (nil without token)
+func getTokenClaims(r *rest.Request) map[string]interface{} {
+	switch payload := r.Env["JWT_PAYLOAD"].(type) {
+	case jwt.MapClaims:
+		return payload
+	case map[string]interface{}:
+		return payload
+	}
+	return nil
+}
+
+// isLoginLinkSession returns true if the JWT token of the request was given by a login link
+func isLoginLinkSession(r *rest.Request) bool {
+	link, _ := getTokenClaims(r)[LoginLinkClaim].(bool)
+	return link
+}
+
+// HashPassword returns the bcrypt hash of a password
+func HashPassword(password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		panic(err)
+	}
+	return string(hash)
+}
+
+// CheckPassword returns true if the password matches the bcrypt hash
+func CheckPassword(hash string, password string) bool {
+	return password != "" && bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// IsPasswordHashed returns true if the value is a bcrypt hash
+func IsPasswordHashed(value string) bool {
+	_, err := bcrypt.Cost([]byte(value))
+	return err == nil
+}
+
+// InitSuperAdminPassword returns the superadmin password hash saved in the store
+// If there is no password yet, a new one is generated and returned in clear text (with its hash)
+// A password saved in clear text by a previous version is hashed
+func InitSuperAdminPassword(store Store) (string, string) {
+	prop := &Property{}
+	store.GetDocument(PropertiesBucketName, SuperAdminPasswordProperty, prop)
+	if IsPasswordHashed(prop.Value) {
+		return "", prop.Value
+	}
+
+	password := prop.Value
+	if password == "" {
+		password = NewPassword(12)
+	}
+	return password, saveSuperAdminPassword(store, password)
+}
+
+// ResetSuperAdminPassword generates and saves a new superadmin password
+func ResetSuperAdminPassword(store Store) string {
+	password := NewPassword(12)
+	saveSuperAdminPassword(store, password)
+	return password
+}
+
+func saveSuperAdminPassword(store Store, password string) string {
+	hash := HashPassword(password)
+	if err := store.CommitDocument(PropertiesBucketName, SuperAdminPasswordProperty, &Property{Value: hash}); err != nil {
+		panic(err)
+	}
+	return hash
+}
+
 // NewPassword generates random passwords
 // Inspired by "github.com/cmiceli/password-generator-go"
 func NewPassword(length int) string {
@@ -28,6 +28,24 @@ func TestAdminPriviledge(t *testing.T) {
 	assert.False(t, hasSuperAdminPriviledge(r))
 }
 
+func TestOrganizerPriviledge(t *testing.T) {
+	r := NewRequest()
+	r.PathParams["event"] = "testevent"
+	r.Env["REMOTE_USER"] = GetOrganizerLogin("testevent", "Alice@School.org")
+	assert.Equal(t, "testevent/alice@school.org", r.Env["REMOTE_USER"])
+
+	// The organizer must have been found in the event by Authorize
+	assert.False(t, hasAdminPriviledge(r))
+	r.Env[OrganizerEnvKey] = &entities.Organizer{Email: "bob@school.org"}
+	assert.False(t, hasAdminPriviledge(r))
+	r.Env[OrganizerEnvKey] = &entities.Organizer{Email: "alice@school.org"}
+	assert.True(t, hasAdminPriviledge(r))
+	assert.False(t, hasSuperAdminPriviledge(r))
+
+	r.PathParams["event"] = "otherevent"
+	assert.False(t, hasAdminPriviledge(r))
+}
+
 func TestSuperadminPriviledge(t *testing.T) {
 	r := NewRequest()
 	r.PathParams["event"] = "testevent"
@@ -76,34 +94,132 @@ func TestAuthentificator(t *testing.T) {
 	defer os.Remove("security.db")
 
 	eventService := &EventService{
-		RepositoryService: repositoryService,
-		Secret:            "secret",
+		Store:  repositoryService,
+		Secret: "secret",
 	}
 
 	event, err := entities.NewPendingConfirmationEvent("testevent", "ip", "test@test.com")
 	assert.NoError(t, err)
 
 	eventService.ConfirmAndSaveEvent(event)
-	eventAdminPass := event.AdminPassword
+	eventAdminPass := event.Password
 	assert.Len(t, eventAdminPass, 8)
+	assert.True(t, IsPasswordHashed(eventService.GetEvent(event.Code).AdminPassword))
+
+	superHash := HashPassword("superpass")
 
 	// Wrong login or pass
-	assert.False(t, Authenticate(eventService, "superpass", "a login", "a pass"))
-	assert.False(t, Authenticate(eventService, "superpass", "", "a pass"))
-	assert.False(t, Authenticate(eventService, "superpass", "a login", ""))
+	assert.False(t, Authenticate(eventService, superHash, "a login", "a pass"))
+	assert.False(t, Authenticate(eventService, superHash, "", "a pass"))
+	assert.False(t, Authenticate(eventService, superHash, "a login", ""))
 
 	// Super admin
-	assert.False(t, Authenticate(eventService, "superpass", "superadmin", "a pass"))
-	assert.False(t, Authenticate(eventService, "superpass", "superadmin", ""))
-	assert.True(t, Authenticate(eventService, "superpass", "superadmin", "superpass"))
+	assert.False(t, Authenticate(eventService, superHash, "superadmin", "a pass"))
+	assert.False(t, Authenticate(eventService, superHash, "superadmin", ""))
+	assert.False(t, Authenticate(eventService, superHash, "superadmin", superHash))
+	assert.True(t, Authenticate(eventService, superHash, "superadmin", "superpass"))
 
 	// Event admin
-	assert.False(t, Authenticate(eventService, "superpass", event.Code+"-admin", "a pass"))
-	assert.False(t, Authenticate(eventService, "superpass", event.Code+"-admin", ""))
-	assert.True(t, Authenticate(eventService, "superpass", event.Code+"-admin", eventAdminPass))
+	assert.False(t, Authenticate(eventService, superHash, event.Code+"-admin", "a pass"))
+	assert.False(t, Authenticate(eventService, superHash, event.Code+"-admin", ""))
+	assert.True(t, Authenticate(eventService, superHash, event.Code+"-admin", eventAdminPass))
+
+	// Pending events can't be used
+	pending, _ := entities.NewPendingConfirmationEvent("pending", "ip", "test@test.com")
+	eventService.SaveEvent(pending)
+	assert.False(t, Authenticate(eventService, superHash, "pending-admin", pending.AdminPassword))
+}
+
+func TestHashPasswords(t *testing.T) {
+	store := NewMemoryStore()
+	store.CreateCollectionIfNotExists(EventsBucketName)
+	store.CreateCollectionIfNotExists(PropertiesBucketName)
+	eventService := &EventService{Store: store}
+
+	// Passwords saved in clear text by a previous version
+	legacy, _ := entities.NewPendingConfirmationEvent("legacy", "ip", "test@test.com")
+	legacy.EmailConfirmed = true
+	legacy.AdminPassword = "clearpass"
+	eventService.SaveEvent(legacy)
+	pending, _ := entities.NewPendingConfirmationEvent("pending", "ip", "test@test.com")
+	eventService.SaveEvent(pending)
+	store.CommitDocument(PropertiesBucketName, SuperAdminPasswordProperty, &Property{Value: "superpass"})
+
+	count, err := eventService.HashPasswords()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.True(t, Authenticate(eventService, "", "legacy-admin", "clearpass"))
+	assert.Equal(t, "generatedonconfirm", eventService.GetEvent("pending").AdminPassword)
+
+	count, _ = eventService.HashPasswords()
+	assert.Equal(t, 0, count)
+
+	password, hash := InitSuperAdminPassword(store)
+	assert.Equal(t, "superpass", password)
+	assert.True(t, CheckPassword(hash, "superpass"))
+
+	password, hash = InitSuperAdminPassword(store)
+	assert.Empty(t, password)
+	assert.True(t, CheckPassword(hash, "superpass"))
+
+	password = ResetSuperAdminPassword(store)
+	_, hash = InitSuperAdminPassword(store)
+	assert.True(t, CheckPassword(hash, password))
+	assert.False(t, CheckPassword(hash, "superpass"))
 }
 
 func TestNewPassword(t *testing.T) {
 	assert.Len(t, NewPassword(4), 4)
 	assert.Len(t, NewPassword(10), 10)
 }
+
+func TestRolePermissions(t *testing.T) {
+	event, _ := entities.NewPendingConfirmationEvent("testevent", "ip", "test@test.com")
+	owner, _ := event.AddOrganizer("owner@school.org", "testevent-admin", "", nil)
+	manager, _ := event.AddOrganizer("manager@school.org", "testevent-admin", entities.RoleManager, nil)
+	viewer, _ := event.AddOrganizer("viewer@school.org", "testevent-admin", entities.RoleViewer, nil)
+	lead, _ := event.AddOrganizer("lead@school.org", "testevent-admin", entities.RoleLead, []string{"bar"})
+
+	request := func(organizer *entities.Organizer, activityCode string) *rest.Request {
+		r := NewRequest()
+		r.PathParams["event"] = "testevent"
+		r.PathParams["acode"] = activityCode
+		r.Env["REMOTE_USER"] = GetOrganizerLogin("testevent", organizer.Email)
+		r.Env[OrganizerEnvKey] = organizer
+		return r
+	}
+
+	assert.True(t, hasPermission(request(owner, ""), PermissionManageEvent))
+
+	assert.False(t, hasPermission(request(manager, ""), PermissionManageEvent))
+	assert.True(t, hasPermission(request(manager, "bar"), PermissionEditActivities))
+
+	assert.False(t, hasPermission(request(viewer, "bar"), PermissionEditActivities))
+	assert.False(t, hasPermission(request(viewer, "bar"), PermissionManageParticipants))
+	assert.True(t, hasPermission(request(viewer, "bar"), PermissionReadPrivateData))
+
+	assert.True(t, hasPermission(request(lead, "bar"), PermissionManageParticipants))
+	assert.False(t, hasPermission(request(lead, "cakes"), PermissionManageParticipants))
+	assert.False(t, hasPermission(request(lead, "cakes"), PermissionReadPrivateData))
+	assert.False(t, hasPermission(request(lead, "bar"), PermissionEditActivities))
+	assert.True(t, hasPermission(request(lead, ""), PermissionAccount))
+
+	// The organizer must have been checked by Authorize
+	r := request(owner, "")
+	delete(r.Env, OrganizerEnvKey)
+	assert.False(t, hasPermission(r, PermissionAccount))
+
+	// Event admin and superadmin have all permissions
+	r = NewRequest()
+	r.PathParams["event"] = "testevent"
+	r.Env["REMOTE_USER"] = "testevent-admin"
+	assert.True(t, hasPermission(r, PermissionManageEvent))
+	assert.False(t, hasPermission(r, PermissionSuperAdmin))
+	r.Env["REMOTE_USER"] = SuperAdminLogin
+	assert.True(t, hasPermission(r, PermissionManageEvent))
+	assert.True(t, hasPermission(r, PermissionSuperAdmin))
+
+	// Public handlers need no token, the superadmin permission is never given by a role
+	assert.True(t, hasPermission(NewRequest(), PermissionPublic))
+	assert.False(t, hasPermission(request(owner, ""), PermissionSuperAdmin))
+}
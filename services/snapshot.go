@@ -0,0 +1,182 @@
+package services
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	SnapshotPrefix = "snapshot-"
+	SnapshotSuffix = ".db"
+	SnapshotLayout = "20060102T150405Z"
+)
+
+// SnapshotService periodically copies the BoltDB database to a directory and rotates the copies
+type SnapshotService struct {
+	RepositoryService *RepositoryService
+
+	// Directory where snapshots are written
+	Directory string
+
+	// Delay between two snapshots
+	Interval time.Duration
+
+	// Number of days (resp. weeks) for which the latest snapshot is kept
+	KeepDaily  int
+	KeepWeekly int
+
+	stop func()
+}
+
+type Snapshot struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+	Size      int64     `json:"size"`
+}
+
+// Start takes a first snapshot and then a new one at every interval
+func (ss *SnapshotService) Start() error {
+	if err := os.MkdirAll(ss.Directory, 0700); err != nil {
+		return err
+	}
+
+	if _, err := ss.TakeSnapshot(); err != nil {
+		return err
+	}
+
+	ss.stop = runEvery(ss.Interval, func(now time.Time) {
+		if _, err := ss.TakeSnapshot(); err != nil {
+			log.Printf("Snapshot failed : %s", err)
+		}
+	})
+	return nil
+}
+
+// Stop waits for the current snapshot and stops the scheduler
+func (ss *SnapshotService) Stop() {
+	if ss.stop != nil {
+		ss.stop()
+		ss.stop = nil
+	}
+}
+
+// TakeSnapshot writes a new snapshot and rotates the old ones
+func (ss *SnapshotService) TakeSnapshot() (*Snapshot, error) {
+	return ss.takeSnapshot(time.Now().UTC())
+}
+
+// takeSnapshot writes a snapshot as if it was the given time
+func (ss *SnapshotService) takeSnapshot(now time.Time) (*Snapshot, error) {
+	name := SnapshotPrefix + now.UTC().Format(SnapshotLayout) + SnapshotSuffix
+
+	// Snapshot is written to a temporary file so that a partial copy is never listed
+	tmp, err := ioutil.TempFile(ss.Directory, "tmp-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	var size int64
+	err = ss.RepositoryService.view(func(tx *bolt.Tx) error {
+		size, err = tx.WriteTo(tmp)
+		return err
+	})
+	tmp.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.Rename(tmp.Name(), filepath.Join(ss.Directory, name)); err != nil {
+		return nil, err
+	}
+
+	return &Snapshot{Name: name, CreatedAt: now.UTC().Truncate(time.Second), Size: size}, ss.Rotate()
+}
+
+// Rotate removes the snapshots which are not the latest of one of the last KeepDaily days or KeepWeekly weeks
+func (ss *SnapshotService) Rotate() error {
+	snapshots, err := ss.ListSnapshots()
+	if err != nil {
+		return err
+	}
+
+	keep := make(map[string]bool)
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+	for i, snapshot := range snapshots {
+		// Latest snapshot is always kept
+		if i == 0 {
+			keep[snapshot.Name] = true
+		}
+
+		day := snapshot.CreatedAt.Format("2006-01-02")
+		if !days[day] && len(days) < ss.KeepDaily {
+			days[day] = true
+			keep[snapshot.Name] = true
+		}
+
+		year, w := snapshot.CreatedAt.ISOWeek()
+		week := strconv.Itoa(year) + "-" + strconv.Itoa(w)
+		if !weeks[week] && len(weeks) < ss.KeepWeekly {
+			weeks[week] = true
+			keep[snapshot.Name] = true
+		}
+	}
+
+	for _, snapshot := range snapshots {
+		if !keep[snapshot.Name] {
+			if err := os.Remove(filepath.Join(ss.Directory, snapshot.Name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ListSnapshots returns the available snapshots, newest first
+func (ss *SnapshotService) ListSnapshots() ([]*Snapshot, error) {
+	files, err := ioutil.ReadDir(ss.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	// Files are sorted by name, so by date
+	snapshots := make([]*Snapshot, 0)
+	for i := len(files) - 1; i >= 0; i-- {
+		file := files[i]
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, SnapshotPrefix) || !strings.HasSuffix(name, SnapshotSuffix) {
+			continue
+		}
+		createdAt, err := time.Parse(SnapshotLayout, strings.TrimSuffix(strings.TrimPrefix(name, SnapshotPrefix), SnapshotSuffix))
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, &Snapshot{Name: name, CreatedAt: createdAt, Size: file.Size()})
+	}
+	return snapshots, nil
+}
+
+// GetSnapshots returns the list of available snapshots (superadmin only)
+func (ss *SnapshotService) GetSnapshots(w rest.ResponseWriter, r *rest.Request) {
+	if !hasPermission(r, PermissionSuperAdmin) {
+		rest.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	snapshots, err := ss.ListSnapshots()
+	if err != nil {
+		panic(err)
+	}
+
+	w.WriteJson(snapshots)
+}
@@ -0,0 +1,76 @@
+package services
+
+import (
+	"github.com/stretchr/testify/assert"
+
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRotation(t *testing.T) {
+	repositoryService := NewRepositoryService("snapshot.db")
+	defer os.Remove("snapshot.db")
+	defer repositoryService.ShutDown()
+	defer os.RemoveAll("snapshots")
+
+	repositoryService.CreateCollectionIfNotExists(EventsBucketName)
+
+	snapshotService := &SnapshotService{
+		RepositoryService: repositoryService,
+		Directory:         "snapshots",
+		Interval:          time.Hour,
+		KeepDaily:         3,
+		KeepWeekly:        2,
+	}
+	assert.NoError(t, os.MkdirAll("snapshots", 0700))
+
+	// Two snapshots a day during 3 weeks (from monday 2016-10-03)
+	start := time.Date(2016, 10, 3, 8, 0, 0, 0, time.UTC)
+	for day := 0; day < 21; day++ {
+		for _, hour := range []int{0, 10} {
+			snapshot, err := snapshotService.takeSnapshot(start.AddDate(0, 0, day).Add(time.Duration(hour) * time.Hour))
+			assert.NoError(t, err)
+			assert.True(t, snapshot.Size > 0)
+		}
+	}
+
+	snapshots, err := snapshotService.ListSnapshots()
+	assert.NoError(t, err)
+
+	names := make([]string, 0)
+	for _, snapshot := range snapshots {
+		names = append(names, snapshot.Name)
+	}
+
+	// Latest of the last 3 days, latest of the last 2 weeks (sunday 23rd is the latest of both)
+	assert.Equal(t, []string{
+		"snapshot-20161023T180000Z.db",
+		"snapshot-20161022T180000Z.db",
+		"snapshot-20161021T180000Z.db",
+		"snapshot-20161016T180000Z.db",
+	}, names)
+}
+
+func TestSnapshotScheduler(t *testing.T) {
+	repositoryService := NewRepositoryService("scheduler.db")
+	defer os.Remove("scheduler.db")
+	defer repositoryService.ShutDown()
+	defer os.RemoveAll("scheduledsnapshots")
+
+	snapshotService := &SnapshotService{
+		RepositoryService: repositoryService,
+		Directory:         "scheduledsnapshots",
+		Interval:          time.Hour,
+		KeepDaily:         1,
+		KeepWeekly:        1,
+	}
+
+	// A first snapshot is taken on start
+	assert.NoError(t, snapshotService.Start())
+	snapshotService.Stop()
+
+	snapshots, err := snapshotService.ListSnapshots()
+	assert.NoError(t, err)
+	assert.Len(t, snapshots, 1)
+}
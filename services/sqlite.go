@@ -0,0 +1,647 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/julienbayle/jeparticipe/entities"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema stores events, activities and participants in real tables so that they can be queried with SQL
+// Document fields without a dedicated column are kept as JSON in the "extra" columns
+// Other collections (properties, ...) are stored as JSON documents
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS collections (
+	name TEXT PRIMARY KEY
+);
+CREATE TABLE IF NOT EXISTS documents (
+	collection TEXT NOT NULL,
+	identifier TEXT NOT NULL,
+	data       TEXT NOT NULL,
+	PRIMARY KEY (collection, identifier)
+);
+CREATE TABLE IF NOT EXISTS events (
+	code            TEXT PRIMARY KEY,
+	created_at      TEXT NOT NULL,
+	created_by      TEXT NOT NULL,
+	user_email      TEXT NOT NULL,
+	email_confirmed INTEGER NOT NULL,
+	admin_password  TEXT NOT NULL,
+	config          TEXT,
+	extra           TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS activities (
+	event_code TEXT NOT NULL,
+	code       TEXT NOT NULL,
+	state      TEXT NOT NULL,
+	extra      TEXT NOT NULL,
+	PRIMARY KEY (event_code, code)
+);
+CREATE TABLE IF NOT EXISTS participants (
+	event_code    TEXT NOT NULL,
+	activity_code TEXT NOT NULL,
+	position      INTEGER NOT NULL,
+	code          TEXT NOT NULL,
+	public_text   TEXT NOT NULL,
+	private_text  TEXT NOT NULL,
+	created_at    TEXT NOT NULL,
+	created_by    TEXT NOT NULL,
+	deleted_at    TEXT NOT NULL,
+	email         TEXT NOT NULL DEFAULT '',
+	count         INTEGER NOT NULL DEFAULT 0,
+	waitlisted    INTEGER NOT NULL DEFAULT 0,
+	extra         TEXT NOT NULL,
+	PRIMARY KEY (event_code, activity_code, position)
+);
+`
+
+// sqliteMigrations adds the columns created after the first version of the schema, by table
+// The values of the rows written before are still read from their "extra" column
+var sqliteMigrations = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"participants", "email", "TEXT NOT NULL DEFAULT ''"},
+	{"participants", "count", "INTEGER NOT NULL DEFAULT 0"},
+	{"participants", "waitlisted", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+var (
+	eventColumns       = []string{"Code", "CreatedAt", "CreatedBy", "UserEmail", "EmailConfirmed", "AdminPassword", "Config"}
+	activityColumns    = []string{"Code", "State", "Participants", "Waitlist"}
+	participantColumns = []string{"code", "text", "admintext", "createdAt", "createdBy", "deletedAt", "email", "count"}
+)
+
+// SqliteStore is the SQLite implementation of Store
+type SqliteStore struct {
+	Db *sql.DB
+}
+
+// NewSqliteStore opens existing database or creates a new one
+func NewSqliteStore(dbFilePath string) *SqliteStore {
+	Db, err := sql.Open("sqlite", dbFilePath)
+	if err != nil {
+		panic("Unable to create database " + err.Error())
+	}
+
+	// SQLite allows only one writer at a time
+	Db.SetMaxOpenConns(1)
+
+	if _, err = Db.Exec(sqliteSchema); err != nil {
+		panic("Unable to create database schema " + err.Error())
+	}
+
+	if err = migrateSqliteSchema(Db); err != nil {
+		panic("Unable to migrate database schema " + err.Error())
+	}
+
+	return &SqliteStore{Db: Db}
+}
+
+// migrateSqliteSchema adds the missing columns to a database created by a previous version
+func migrateSqliteSchema(db *sql.DB) error {
+	for _, migration := range sqliteMigrations {
+		rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, migration.table)
+		if err != nil {
+			return err
+		}
+		columns, err := scanStrings(rows)
+		if err != nil {
+			return err
+		}
+
+		exists := false
+		for _, column := range columns {
+			exists = exists || column == migration.column
+		}
+		if exists {
+			continue
+		}
+
+		if _, err = db.Exec(`ALTER TABLE ` + migration.table + ` ADD COLUMN ` + migration.column + ` ` + migration.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ShutDown closes the database (do defer this)
+func (ss *SqliteStore) ShutDown() {
+	ss.Db.Close()
+}
+
+// CreateCollectionIfNotExists creates a new document collection
+func (ss *SqliteStore) CreateCollectionIfNotExists(collection string) error {
+	_, err := ss.Db.Exec(`INSERT OR IGNORE INTO collections (name) VALUES (?)`, collection)
+	return err
+}
+
+// GetCollections returns the names of the collections starting with prefix
+func (ss *SqliteStore) GetCollections(prefix string) ([]string, error) {
+	rows, err := ss.Db.Query(`SELECT name FROM collections WHERE substr(name, 1, ?) = ? ORDER BY name`, len(prefix), prefix)
+	if err != nil {
+		return nil, err
+	}
+	return scanStrings(rows)
+}
+
+// GetIdentifiers returns the identifiers of the documents of a collection
+func (ss *SqliteStore) GetIdentifiers(collection string) ([]string, error) {
+	tx, err := ss.Db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return getIdentifiers(tx, collection)
+}
+
+// getIdentifiers reads the identifiers of a collection from the table matching the collection
+func getIdentifiers(tx *sql.Tx, collection string) ([]string, error) {
+	if err := checkCollection(tx, collection); err != nil {
+		return nil, err
+	}
+
+	var rows *sql.Rows
+	var err error
+	switch {
+	case collection == EventsBucketName:
+		rows, err = tx.Query(`SELECT code FROM events ORDER BY code`)
+	case strings.HasPrefix(collection, GetActivityBucketName("")):
+		rows, err = tx.Query(`SELECT code FROM activities WHERE event_code = ? ORDER BY code`, strings.TrimPrefix(collection, GetActivityBucketName("")))
+	default:
+		rows, err = tx.Query(`SELECT identifier FROM documents WHERE collection = ? ORDER BY identifier`, collection)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return scanStrings(rows)
+}
+
+// GetDocument gets a document from a collection
+func (ss *SqliteStore) GetDocument(collection string, identifier string, document interface{}) error {
+	tx, err := ss.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	return ss.getDocument(tx, collection, identifier, document)
+}
+
+// CommitDocument commits a document to the database (create / update)
+func (ss *SqliteStore) CommitDocument(collection string, identifier string, document interface{}) error {
+	tx, err := ss.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = ss.commitDocument(tx, collection, identifier, document); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateDocument loads, updates and commits a document in a single transaction
+func (ss *SqliteStore) UpdateDocument(collection string, identifier string, document interface{}, update func() error) error {
+	tx, err := ss.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = ss.getDocument(tx, collection, identifier, document); err != nil {
+		return err
+	}
+	if err = update(); err != nil {
+		return err
+	}
+	if err = ss.commitDocument(tx, collection, identifier, document); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateDocumentGroup loads, updates and commits several documents in a single transaction
+func (ss *SqliteStore) UpdateDocumentGroup(collection string, identifiers []string, documents []interface{}, update func() error) error {
+	tx, err := ss.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, identifier := range identifiers {
+		if err = ss.getDocument(tx, collection, identifier, documents[i]); err != nil {
+			return err
+		}
+	}
+	if err = update(); err != nil {
+		return err
+	}
+	for i, identifier := range identifiers {
+		if err = ss.commitDocument(tx, collection, identifier, documents[i]); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UpdateDocuments loads, updates and commits all the documents of a collection in a single transaction
+func (ss *SqliteStore) UpdateDocuments(collection string, newDocument func(identifier string) interface{}, update func(identifier string, document interface{}) (bool, error)) error {
+	tx, err := ss.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	identifiers, err := getIdentifiers(tx, collection)
+	if err != nil {
+		return err
+	}
+
+	for _, identifier := range identifiers {
+		document := newDocument(identifier)
+		if err = ss.getDocument(tx, collection, identifier, document); err != nil {
+			return err
+		}
+		changed, err := update(identifier, document)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			continue
+		}
+		if err = ss.commitDocument(tx, collection, identifier, document); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteDocument removes a document from the table matching its collection
+func (ss *SqliteStore) DeleteDocument(collection string, identifier string) error {
+	tx, err := ss.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = checkCollection(tx, collection); err != nil {
+		return err
+	}
+	if err = deleteDocument(tx, collection, identifier); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteDocumentIf loads a document and removes it if check returns true in a single transaction
+func (ss *SqliteStore) DeleteDocumentIf(collection string, identifier string, document interface{}, check func() bool) (bool, error) {
+	tx, err := ss.Db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if err = ss.getDocument(tx, collection, identifier, document); err != nil {
+		return false, err
+	}
+	if !check() {
+		return false, nil
+	}
+	if err = deleteDocument(tx, collection, identifier); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// DeleteCollection removes a collection and the rows of all its documents
+func (ss *SqliteStore) DeleteCollection(collection string) error {
+	tx, err := ss.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	switch {
+	case collection == EventsBucketName:
+		_, err = tx.Exec(`DELETE FROM events`)
+	case strings.HasPrefix(collection, GetActivityBucketName("")):
+		err = deleteActivityRows(tx, strings.TrimPrefix(collection, GetActivityBucketName("")), "")
+	default:
+		_, err = tx.Exec(`DELETE FROM documents WHERE collection = ?`, collection)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(`DELETE FROM collections WHERE name = ?`, collection); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteDocument removes the rows of a document from the table matching its collection
+func deleteDocument(tx *sql.Tx, collection string, identifier string) error {
+	var err error
+	switch {
+	case collection == EventsBucketName:
+		_, err = tx.Exec(`DELETE FROM events WHERE code = ?`, identifier)
+	case strings.HasPrefix(collection, GetActivityBucketName("")):
+		err = deleteActivityRows(tx, strings.TrimPrefix(collection, GetActivityBucketName("")), identifier)
+	default:
+		_, err = tx.Exec(`DELETE FROM documents WHERE collection = ? AND identifier = ?`, collection, identifier)
+	}
+	return err
+}
+
+// getDocument reads a document from the table matching its collection
+func (ss *SqliteStore) getDocument(tx *sql.Tx, collection string, identifier string, document interface{}) error {
+	if err := checkCollection(tx, collection); err != nil {
+		return err
+	}
+
+	var data []byte
+	var err error
+	switch {
+	case collection == EventsBucketName:
+		data, err = getEventRow(tx, identifier)
+	case strings.HasPrefix(collection, GetActivityBucketName("")):
+		data, err = getActivityRow(tx, strings.TrimPrefix(collection, GetActivityBucketName("")), identifier)
+	default:
+		err = tx.QueryRow(`SELECT data FROM documents WHERE collection = ? AND identifier = ?`, collection, identifier).Scan(&data)
+	}
+
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, document)
+}
+
+// commitDocument writes a document to the table matching its collection
+func (ss *SqliteStore) commitDocument(tx *sql.Tx, collection string, identifier string, document interface{}) error {
+	if err := checkCollection(tx, collection); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case collection == EventsBucketName:
+		return putEventRow(tx, identifier, data)
+	case strings.HasPrefix(collection, GetActivityBucketName("")):
+		return putActivityRow(tx, strings.TrimPrefix(collection, GetActivityBucketName("")), identifier, data)
+	default:
+		_, err = tx.Exec(`INSERT OR REPLACE INTO documents (collection, identifier, data) VALUES (?, ?, ?)`, collection, identifier, string(data))
+		return err
+	}
+}
+
+// checkCollection returns an error if the collection has not been created
+func checkCollection(tx *sql.Tx, collection string) error {
+	var name string
+	err := tx.QueryRow(`SELECT name FROM collections WHERE name = ?`, collection).Scan(&name)
+	if err == sql.ErrNoRows {
+		return errors.New("Collection " + collection + " does not exist")
+	}
+	return err
+}
+
+// getEventRow reads an event row as a JSON document
+func getEventRow(tx *sql.Tx, code string) ([]byte, error) {
+	var createdAt, extra string
+	var config sql.NullString
+	event := &entities.Event{}
+	err := tx.QueryRow(`SELECT code, created_at, created_by, user_email, email_confirmed, admin_password, config, extra
+		FROM events WHERE code = ?`, code).Scan(
+		&event.Code, &createdAt, &event.CreatedBy, &event.UserEmail, &event.EmailConfirmed, &event.AdminPassword, &config, &extra)
+	if err != nil {
+		return nil, err
+	}
+
+	if event.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+		return nil, err
+	}
+	if config.Valid {
+		event.Config = []byte(config.String)
+	}
+
+	fields, err := toFields(event)
+	if err != nil {
+		return nil, err
+	}
+	return withExtra(fields, extra)
+}
+
+// putEventRow writes a JSON document as an event row
+func putEventRow(tx *sql.Tx, code string, data []byte) error {
+	event := &entities.Event{}
+	if err := json.Unmarshal(data, event); err != nil {
+		return err
+	}
+	extra, err := extraOf(data, eventColumns)
+	if err != nil {
+		return err
+	}
+
+	var config sql.NullString
+	if event.Config != nil {
+		config = sql.NullString{String: string(event.Config), Valid: true}
+	}
+
+	_, err = tx.Exec(`INSERT OR REPLACE INTO events
+		(code, created_at, created_by, user_email, email_confirmed, admin_password, config, extra)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		code, event.CreatedAt.Format(time.RFC3339Nano), event.CreatedBy, event.UserEmail, event.EmailConfirmed, event.AdminPassword, config, extra)
+	return err
+}
+
+// getActivityRow reads an activity row and its participants as a JSON document
+func getActivityRow(tx *sql.Tx, eventCode string, code string) ([]byte, error) {
+	var extra string
+	activity := &entities.Activity{}
+	err := tx.QueryRow(`SELECT code, state, extra FROM activities WHERE event_code = ? AND code = ?`, eventCode, code).Scan(
+		&activity.Code, &activity.State, &extra)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`SELECT code, public_text, private_text, created_at, created_by, deleted_at, email, count, waitlisted, extra
+		FROM participants WHERE event_code = ? AND activity_code = ? ORDER BY position`, eventCode, code)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	participants := make([]json.RawMessage, 0)
+	waitlist := make([]json.RawMessage, 0)
+	for rows.Next() {
+		var createdAt, deletedAt, participantExtra string
+		var waitlisted bool
+		participant := &entities.Participant{}
+		err = rows.Scan(&participant.Code, &participant.PublicText, &participant.PrivateText, &createdAt, &participant.CreatedBy, &deletedAt,
+			&participant.Email, &participant.Count, &waitlisted, &participantExtra)
+		if err != nil {
+			return nil, err
+		}
+		if participant.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+			return nil, err
+		}
+		if participant.DeletedAt, err = time.Parse(time.RFC3339Nano, deletedAt); err != nil {
+			return nil, err
+		}
+
+		fields, err := toFields(participant)
+		if err != nil {
+			return nil, err
+		}
+		data, err := withExtra(fields, participantExtra)
+		if err != nil {
+			return nil, err
+		}
+		if waitlisted {
+			waitlist = append(waitlist, data)
+		} else {
+			participants = append(participants, data)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	fields, err := toFields(activity)
+	if err != nil {
+		return nil, err
+	}
+	if fields["Participants"], err = json.Marshal(participants); err != nil {
+		return nil, err
+	}
+	if fields["Waitlist"], err = json.Marshal(waitlist); err != nil {
+		return nil, err
+	}
+
+	// An activity written before the waitlist column still has its waiting list in its "extra" column
+	return withExtra(fields, extra)
+}
+
+// putActivityRow writes a JSON document as an activity row and replaces its participants
+func putActivityRow(tx *sql.Tx, eventCode string, code string, data []byte) error {
+	activity := &struct {
+		State        string
+		Participants []json.RawMessage
+		Waitlist     []json.RawMessage
+	}{}
+	if err := json.Unmarshal(data, activity); err != nil {
+		return err
+	}
+	extra, err := extraOf(data, activityColumns)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT OR REPLACE INTO activities (event_code, code, state, extra) VALUES (?, ?, ?, ?)`,
+		eventCode, code, activity.State, extra)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM participants WHERE event_code = ? AND activity_code = ?`, eventCode, code)
+	if err != nil {
+		return err
+	}
+
+	// Waitlisted participants follow the participants
+	rows := append(activity.Participants, activity.Waitlist...)
+	for position, participantData := range rows {
+		participant := &entities.Participant{}
+		if err = json.Unmarshal(participantData, participant); err != nil {
+			return err
+		}
+		participantExtra, err := extraOf(participantData, participantColumns)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`INSERT INTO participants
+			(event_code, activity_code, position, code, public_text, private_text, created_at, created_by, deleted_at, email, count, waitlisted, extra)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			eventCode, code, position, participant.Code, participant.PublicText, participant.PrivateText,
+			participant.CreatedAt.Format(time.RFC3339Nano), participant.CreatedBy, participant.DeletedAt.Format(time.RFC3339Nano),
+			participant.Email, participant.Count, position >= len(activity.Participants), participantExtra)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteActivityRows removes an activity and its participants, or all the activities of the event if code is empty
+func deleteActivityRows(tx *sql.Tx, eventCode string, code string) error {
+	_, err := tx.Exec(`DELETE FROM participants WHERE event_code = ? AND (? = '' OR activity_code = ?)`, eventCode, code, code)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM activities WHERE event_code = ? AND (? = '' OR code = ?)`, eventCode, code, code)
+	return err
+}
+
+// scanStrings reads and closes rows made of a single text column
+func scanStrings(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+	values := make([]string, 0)
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// toFields splits a value into its JSON fields
+func toFields(v interface{}) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]json.RawMessage)
+	return fields, json.Unmarshal(data, &fields)
+}
+
+// withExtra adds the fields stored in an "extra" column and returns the whole JSON document
+func withExtra(fields map[string]json.RawMessage, extra string) ([]byte, error) {
+	extraFields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal([]byte(extra), &extraFields); err != nil {
+		return nil, err
+	}
+	for k, v := range extraFields {
+		fields[k] = v
+	}
+	return json.Marshal(fields)
+}
+
+// extraOf returns the JSON fields of a document which are not stored in a dedicated column
+func extraOf(data []byte, columns []string) (string, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return "", err
+	}
+	for _, column := range columns {
+		delete(fields, column)
+	}
+	extra, err := json.Marshal(fields)
+	return string(extra), err
+}
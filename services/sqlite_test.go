@@ -0,0 +1,169 @@
+package services_test
+
+import (
+	"github.com/julienbayle/jeparticipe/entities"
+	"github.com/julienbayle/jeparticipe/services"
+	"github.com/stretchr/testify/assert"
+	_ "modernc.org/sqlite"
+
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSqliteRepository(t *testing.T) {
+	sqliteStore := services.NewSqliteStore("repo.sqlite")
+	defer os.Remove("repo.sqlite")
+	defer sqliteStore.ShutDown()
+
+	assert.NotNil(t, sqliteStore)
+	testStore(t, sqliteStore)
+}
+
+func TestSqliteEntities(t *testing.T) {
+	sqliteStore := services.NewSqliteStore("entities.sqlite")
+	defer os.Remove("entities.sqlite")
+	defer sqliteStore.ShutDown()
+
+	sqliteStore.CreateCollectionIfNotExists(services.EventsBucketName)
+	sqliteStore.CreateCollectionIfNotExists(services.GetActivityBucketName("testevent"))
+
+	// ------------------------------------
+	// Event round trip
+	// ------------------------------------
+
+	event, _ := entities.NewPendingConfirmationEvent("testevent", "ip", "test@test.com")
+	event.Config = []byte(`{"title":"Kermesse"}`)
+	assert.NoError(t, sqliteStore.CommitDocument(services.EventsBucketName, event.Code, event))
+
+	recoverEvent := &entities.Event{}
+	assert.NoError(t, sqliteStore.GetDocument(services.EventsBucketName, event.Code, recoverEvent))
+	assert.Equal(t, event.Code, recoverEvent.Code)
+	assert.Equal(t, event.UserEmail, recoverEvent.UserEmail)
+	assert.Equal(t, event.AdminPassword, recoverEvent.AdminPassword)
+	assert.True(t, event.CreatedAt.Equal(recoverEvent.CreatedAt))
+	assert.Equal(t, string(event.Config), string(recoverEvent.Config))
+
+	// ------------------------------------
+	// Activity round trip
+	// ------------------------------------
+
+	activity := entities.NewActivity("bar")
+	activity.Title = "Bar"
+	activity.StartAt = time.Date(2017, 6, 24, 14, 0, 0, 0, time.UTC)
+	p1 := activity.AddParticipant("public 1", "private 1", "ip 1")
+	p1.Email = "p1@test.com"
+	p1.Count = 3
+	p2 := activity.AddParticipant("public 2", "private 2", "ip 2")
+	activity.RemoveParticipant(p2.Code)
+	activity.AddToWaitlist("waiting", "private", "ip 3")
+	assert.NoError(t, sqliteStore.CommitDocument(services.GetActivityBucketName("testevent"), activity.Code, activity))
+
+	recoverActivity := entities.NewActivity("bar")
+	assert.NoError(t, sqliteStore.GetDocument(services.GetActivityBucketName("testevent"), activity.Code, recoverActivity))
+	assert.Equal(t, activity.State, recoverActivity.State)
+	assert.Equal(t, "Bar", recoverActivity.Title)
+	assert.True(t, activity.StartAt.Equal(recoverActivity.StartAt))
+	assert.Len(t, recoverActivity.Participants, 2)
+	assert.Equal(t, "public 1", recoverActivity.Participants[0].PublicText)
+	assert.Equal(t, "private 2", recoverActivity.Participants[1].PrivateText)
+	assert.True(t, p2.DeletedAt.Equal(recoverActivity.GetParticipant(p2.Code).DeletedAt))
+	assert.Equal(t, "p1@test.com", recoverActivity.Participants[0].Email)
+	assert.Equal(t, 3, recoverActivity.Participants[0].Count)
+	assert.Len(t, recoverActivity.Waitlist, 1)
+	assert.Equal(t, "waiting", recoverActivity.Waitlist[0].PublicText)
+
+	// ------------------------------------
+	// Data can be queried with SQL
+	// ------------------------------------
+
+	var count int
+	err := sqliteStore.Db.QueryRow(`SELECT COUNT(*) FROM participants p
+		JOIN events e ON e.code = p.event_code
+		WHERE e.user_email = ? AND p.activity_code = ?`, "test@test.com", "bar").Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	err = sqliteStore.Db.QueryRow(`SELECT SUM(count) FROM participants WHERE email = ? AND waitlisted = 0`, "p1@test.com").Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	err = sqliteStore.Db.QueryRow(`SELECT COUNT(*) FROM participants WHERE waitlisted = 1`).Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// ------------------------------------
+	// Updates replace participants
+	// ------------------------------------
+
+	activity.Participants = activity.Participants[:1]
+	activity.Waitlist = nil
+	assert.NoError(t, sqliteStore.CommitDocument(services.GetActivityBucketName("testevent"), activity.Code, activity))
+	recoverActivity = entities.NewActivity("bar")
+	assert.NoError(t, sqliteStore.GetDocument(services.GetActivityBucketName("testevent"), activity.Code, recoverActivity))
+	assert.Len(t, recoverActivity.Participants, 1)
+	assert.Len(t, recoverActivity.Waitlist, 0)
+
+	// ------------------------------------
+	// Deleting the activities collection removes the rows
+	// ------------------------------------
+
+	assert.NoError(t, sqliteStore.DeleteCollection(services.GetActivityBucketName("testevent")))
+	assert.NoError(t, sqliteStore.Db.QueryRow(`SELECT COUNT(*) FROM participants`).Scan(&count))
+	assert.Equal(t, 0, count)
+	assert.NoError(t, sqliteStore.Db.QueryRow(`SELECT COUNT(*) FROM activities`).Scan(&count))
+	assert.Equal(t, 0, count)
+
+	assert.NoError(t, sqliteStore.DeleteDocument(services.EventsBucketName, event.Code))
+	assert.NoError(t, sqliteStore.Db.QueryRow(`SELECT COUNT(*) FROM events`).Scan(&count))
+	assert.Equal(t, 0, count)
+}
+
+func TestSqliteMigration(t *testing.T) {
+	defer os.Remove("migration.sqlite")
+
+	// ------------------------------------
+	// Database written by a version without the email, count and waitlisted columns
+	// ------------------------------------
+
+	db, err := sql.Open("sqlite", "migration.sqlite")
+	assert.NoError(t, err)
+	_, err = db.Exec(`
+		CREATE TABLE collections (name TEXT PRIMARY KEY);
+		CREATE TABLE activities (event_code TEXT NOT NULL, code TEXT NOT NULL, state TEXT NOT NULL, extra TEXT NOT NULL,
+			PRIMARY KEY (event_code, code));
+		CREATE TABLE participants (event_code TEXT NOT NULL, activity_code TEXT NOT NULL, position INTEGER NOT NULL,
+			code TEXT NOT NULL, public_text TEXT NOT NULL, private_text TEXT NOT NULL, created_at TEXT NOT NULL,
+			created_by TEXT NOT NULL, deleted_at TEXT NOT NULL, extra TEXT NOT NULL,
+			PRIMARY KEY (event_code, activity_code, position));
+		INSERT INTO collections VALUES ('activities-testevent');
+		INSERT INTO activities VALUES ('testevent', 'bar', 'open', '{"Waitlist":[{"code":"w","text":"waiting"}]}');
+		INSERT INTO participants VALUES ('testevent', 'bar', 0, 'p', 'public', 'private',
+			'2017-06-24T14:00:00Z', 'ip', '2100-01-01T00:00:00Z', '{"email":"p@test.com","count":2}');`)
+	assert.NoError(t, err)
+	db.Close()
+
+	// ------------------------------------
+	// Columns are added, old rows are still read from their extra column
+	// ------------------------------------
+
+	sqliteStore := services.NewSqliteStore("migration.sqlite")
+	defer sqliteStore.ShutDown()
+
+	activity := entities.NewActivity("bar")
+	assert.NoError(t, sqliteStore.GetDocument(services.GetActivityBucketName("testevent"), "bar", activity))
+	assert.Len(t, activity.Participants, 1)
+	assert.Equal(t, "p@test.com", activity.Participants[0].Email)
+	assert.Equal(t, 2, activity.Participants[0].Count)
+	assert.Len(t, activity.Waitlist, 1)
+	assert.Equal(t, "waiting", activity.Waitlist[0].PublicText)
+
+	// Written again, the values are moved to the columns
+	assert.NoError(t, sqliteStore.CommitDocument(services.GetActivityBucketName("testevent"), "bar", activity))
+	var count int
+	assert.NoError(t, sqliteStore.Db.QueryRow(`SELECT count FROM participants WHERE email = ?`, "p@test.com").Scan(&count))
+	assert.Equal(t, 2, count)
+	assert.NoError(t, sqliteStore.Db.QueryRow(`SELECT COUNT(*) FROM participants WHERE waitlisted = 1`).Scan(&count))
+	assert.Equal(t, 1, count)
+}
@@ -0,0 +1,63 @@
+package services
+
+import (
+	"strings"
+)
+
+// Store is a document oriented persistence layer
+// Documents are JSON serializable values grouped in named collections
+type Store interface {
+	// CreateCollectionIfNotExists creates a new document collection
+	CreateCollectionIfNotExists(collection string) error
+
+	// GetCollections returns the sorted names of the collections starting with prefix
+	GetCollections(prefix string) ([]string, error)
+
+	// GetIdentifiers returns the sorted identifiers of the documents of a collection
+	GetIdentifiers(collection string) ([]string, error)
+
+	// GetDocument gets a document from a collection (document is left untouched if it does not exist)
+	GetDocument(collection string, identifier string, document interface{}) error
+
+	// CommitDocument commits a document to a collection (create / update)
+	CommitDocument(collection string, identifier string, document interface{}) error
+
+	// UpdateDocument loads a document, calls update and commits the document in a single transaction
+	// Nothing is committed if update returns an error
+	UpdateDocument(collection string, identifier string, document interface{}, update func() error) error
+
+	// UpdateDocumentGroup loads several documents of a collection, calls update and commits them all in a single transaction
+	// Documents which do not exist are left untouched before update, nothing is committed if update returns an error
+	UpdateDocumentGroup(collection string, identifiers []string, documents []interface{}, update func() error) error
+
+	// UpdateDocuments loads every document of a collection, calls update on each and commits them in a single transaction
+	// newDocument returns the value to load a document into, update returns false to leave a document unchanged
+	// Nothing is committed if update returns an error
+	UpdateDocuments(collection string, newDocument func(identifier string) interface{}, update func(identifier string, document interface{}) (bool, error)) error
+
+	// DeleteDocument removes a document from a collection (does nothing if the document does not exist)
+	DeleteDocument(collection string, identifier string) error
+
+	// DeleteDocumentIf loads a document and removes it if check returns true, in a single transaction
+	// Document is left untouched before check if it does not exist, returns true if the document has been removed
+	DeleteDocumentIf(collection string, identifier string, document interface{}, check func() bool) (bool, error)
+
+	// DeleteCollection removes a collection and all its documents (does nothing if the collection does not exist)
+	DeleteCollection(collection string) error
+
+	// ShutDown releases the resources used by the store (do defer this)
+	ShutDown()
+}
+
+// NewStore opens the store described by an URL like "bolt://jeparticipe.db" or "sqlite://jeparticipe.sqlite"
+// An URL without scheme is the path to a BoltDB file
+func NewStore(dbUrl string) Store {
+	switch {
+	case strings.HasPrefix(dbUrl, "sqlite://"):
+		return NewSqliteStore(strings.TrimPrefix(dbUrl, "sqlite://"))
+	case strings.HasPrefix(dbUrl, "bolt://"):
+		return NewRepositoryService(strings.TrimPrefix(dbUrl, "bolt://"))
+	default:
+		return NewRepositoryService(dbUrl)
+	}
+}